@@ -1,22 +1,61 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+	_ "time/tzdata" // IANA zones for user timezones, even without system tzdata
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
 )
 
 type User struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
+	Timezone string `json:"timezone,omitempty"` // IANA name; UTC when empty
+	Email    string `json:"email,omitempty"`
+	// EmailVerified is set alongside Email.
+	EmailVerified *bool `json:"emailVerified,omitempty"`
 }
 
 type Card struct {
@@ -24,60 +63,420 @@ type Card struct {
 	Front string `json:"front"`
 	Back  string `json:"back"`
 	// DeckID omitted from returning Card in some endpoints; include if useful:
-	DeckID string `json:"deckId,omitempty"`
+	DeckID string   `json:"deckId,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Flag   string   `json:"flag,omitempty"`
+	// Hint is shown during study after the user's hint delay.
+	Hint string `json:"hint,omitempty"`
+	// Images are up to maxCardImages http(s) URLs, stored as a JSON array.
+	Images []string `json:"images,omitempty"`
+	// MyNote is the requesting user's private note, on card fetches made
+	// with an access token.
+	MyNote string `json:"myNote,omitempty"`
+	// Position orders cards within their deck; set where cards are listed in order.
+	Position *int `json:"position,omitempty"`
+	// MasteryLevel is set when listing a deck's cards for a specific user.
+	MasteryLevel string `json:"masteryLevel,omitempty"`
 }
 
 type Deck struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description,omitempty"`
-	UserID      string `json:"userId"`
-	Cards       []Card `json:"cards"`
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description,omitempty"`
+	UserID        string   `json:"userId"`
+	Slug          string   `json:"slug,omitempty"`
+	IsPublic      bool     `json:"isPublic"`
+	CopiedFrom    string   `json:"copiedFrom,omitempty"`
+	ParentID      string   `json:"parentId,omitempty"`
+	CaseSensitive bool     `json:"caseSensitive"`
+	Archived      bool     `json:"archived"`
+	DefaultSide   string   `json:"defaultSide"` // side clients show first: front or back
+	Tags          []string `json:"tags,omitempty"`
+	Cards         []Card   `json:"cards"`
+}
+
+// Config holds settings read from the environment at startup.
+type Config struct {
+	// PrettyJSON indents JSON responses; enable with FLASHCARDS_JSON_PRETTY=true in development.
+	PrettyJSON bool
+	// UsernameChangeCooldown is how long a user must wait between username changes.
+	UsernameChangeCooldown time.Duration
+	DBConnectMaxAttempts   int
+	DBConnectMaxWait       time.Duration
+	// PublicBaseURL overrides the origin inferred from requests in generated
+	// links. Emailed links are only built from it, never from the request's
+	// Host header, so no verification email is sent while it is unset.
+	PublicBaseURL  string
+	EmbedScriptURL string
+	// SecondsPerCard is the session estimate used when a user has no timed reviews.
+	SecondsPerCard int
+	// StudyTokenSecret signs offline study tokens (STUDY_TOKEN_SECRET). When
+	// unset, a random secret is used and tokens don't survive a restart.
+	StudyTokenSecret []byte
+	// AdminToken is the bearer token for /admin routes; they are disabled when empty.
+	AdminToken string
+	// MaxCardsPerDeck is enforced by a database trigger (MAX_CARDS_PER_DECK);
+	// 0 means no limit.
+	MaxCardsPerDeck int
+	// CSRFProtection requires an X-CSRF-Token header matching the csrf_token
+	// cookie on unsafe requests from browsers (CSRF_PROTECTION=true).
+	CSRFProtection bool
+	// TrustedProxies are the load balancers allowed to set X-Forwarded-For and
+	// X-Forwarded-Proto (FLASHCARDS_TRUSTED_PROXIES, comma-separated IPs).
+	TrustedProxies []net.IP
+	// OnboardDeck gives each new user a copy of the onboarding.json deck
+	// (ONBOARD_DECK=true).
+	OnboardDeck bool
+	// AuthTokenSecret signs login tokens (AUTH_TOKEN_SECRET). When unset, a
+	// random secret is used and users must log in again after a restart.
+	AuthTokenSecret []byte
+	// Google sign-in is enabled when GOOGLE_CLIENT_ID is set. The redirect
+	// URL must match the one registered with Google.
+	GoogleClientID     string
+	GoogleClientSecret string
+	GoogleRedirectURL  string
+	// Email is sent through SMTP_ADDR (host:port) when set, authenticating
+	// with SMTP_USERNAME/SMTP_PASSWORD if given; otherwise it is only logged.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// PasswordResetURL is the frontend page that asks for the new password
+	// (PASSWORD_RESET_URL); reset emails link to it with ?token= appended and
+	// the page posts the token to /auth/reset-password. Password reset emails
+	// are not sent while it is unset.
+	PasswordResetURL string
+	// StrictForeignKeys makes existing foreign key violations found at
+	// startup fatal instead of only logged (STRICT_FOREIGN_KEYS=true).
+	StrictForeignKeys bool
+	// Envelope wraps responses as {"data", "meta"} / {"error": {...}}; enable with ENVELOPE=true.
+	Envelope bool
+	// UsernameCheckRateLimit is how many username availability checks one
+	// client IP may make per minute (USERNAME_CHECK_RATE_LIMIT); 0 disables it.
+	UsernameCheckRateLimit int
+}
+
+func loadConfig() Config {
+	return Config{
+		PrettyJSON:             envBool("FLASHCARDS_JSON_PRETTY", false),
+		UsernameChangeCooldown: time.Duration(envInt("USERNAME_CHANGE_COOLDOWN_DAYS", 30)) * 24 * time.Hour,
+		DBConnectMaxAttempts:   envInt("DB_CONNECT_MAX_ATTEMPTS", 10),
+		DBConnectMaxWait:       envDuration("DB_CONNECT_MAX_WAIT", time.Minute),
+		PublicBaseURL:          strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/"),
+		EmbedScriptURL:         envString("EMBED_SCRIPT_URL", "https://cdn.example.com/flashcards/embed.js"),
+		SecondsPerCard:         envInt("SESSION_SECONDS_PER_CARD", 10),
+		MaxCardsPerDeck:        envInt("MAX_CARDS_PER_DECK", 5000),
+		Envelope:               envBool("ENVELOPE", false),
+		CSRFProtection:         envBool("CSRF_PROTECTION", false),
+		StrictForeignKeys:      envBool("STRICT_FOREIGN_KEYS", false),
+		TrustedProxies:         envIPs("FLASHCARDS_TRUSTED_PROXIES"),
+		OnboardDeck:            envBool("ONBOARD_DECK", false),
+		AdminToken:             os.Getenv("ADMIN_TOKEN"),
+		StudyTokenSecret:       []byte(os.Getenv("STUDY_TOKEN_SECRET")),
+		AuthTokenSecret:        []byte(os.Getenv("AUTH_TOKEN_SECRET")),
+		GoogleClientID:         os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret:     os.Getenv("GOOGLE_CLIENT_SECRET"),
+		GoogleRedirectURL:      os.Getenv("GOOGLE_REDIRECT_URL"),
+		SMTPAddr:               os.Getenv("SMTP_ADDR"),
+		SMTPUsername:           os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:           os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:               envString("SMTP_FROM", "flashcards@localhost"),
+		PasswordResetURL:       os.Getenv("PASSWORD_RESET_URL"),
+		UsernameCheckRateLimit: envInt("USERNAME_CHECK_RATE_LIMIT", 30),
+	}
 }
 
-var db *sql.DB
+// Server carries the dependencies shared by all handlers.
+type Server struct {
+	db     *sql.DB
+	config Config
+	logger *slog.Logger
+	mailer Emailer
+	// usernameChecks limits GET/POST /users/available per client IP.
+	usernameChecks *rateLimiter
+}
 
 func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "file:flashcards.db?_foreign_keys=on")
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	slog.SetDefault(logger)
+	cfg := loadConfig()
+	if len(cfg.StudyTokenSecret) == 0 {
+		cfg.StudyTokenSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.StudyTokenSecret); err != nil {
+			log.Fatalf("generate study token secret: %v", err)
+		}
+		logger.Warn("STUDY_TOKEN_SECRET not set; offline study tokens will not survive a restart")
+	}
+	if len(cfg.AuthTokenSecret) == 0 {
+		cfg.AuthTokenSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.AuthTokenSecret); err != nil {
+			log.Fatalf("generate auth token secret: %v", err)
+		}
+		logger.Warn("AUTH_TOKEN_SECRET not set; login tokens will not survive a restart")
+	}
+
+	db, err := sql.Open("sqlite3", "file:flashcards.db?_foreign_keys=on")
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
 	defer db.Close()
 
-	if err := runMigrations(db); err != nil {
-		log.Fatalf("migrations: %v", err)
+	s := &Server{db: db, config: cfg, logger: logger, mailer: newEmailer(cfg, logger),
+		usernameChecks: newRateLimiter(cfg.UsernameCheckRateLimit, time.Minute)}
+
+	if err := s.waitForDB(context.Background(), cfg.DBConnectMaxAttempts, cfg.DBConnectMaxWait); err != nil {
+		log.Fatalf("connect db: %v", err)
 	}
 
 	if err := runMigrations(db); err != nil {
 		log.Fatalf("migrations: %v", err)
 	}
+	if err := s.checkForeignKeys(); err != nil {
+		log.Fatalf("foreign keys: %v", err)
+	}
+	if err := setCardLimit(db, cfg.MaxCardsPerDeck); err != nil {
+		log.Fatalf("card limit: %v", err)
+	}
 
 	// Ensure initial user with ID "0"
-	if err := ensureInitialUser(); err != nil {
+	if err := s.ensureInitialUser(); err != nil {
 		log.Fatalf("failed to insert initial user: %v", err)
 	}
 
+	go s.cleanupShareLinks(context.Background(), time.Hour)
+	go s.cleanupRefreshTokens(context.Background(), time.Hour)
+
+	fmt.Println("Server listening on :8080")
+	http.ListenAndServe(":8080", s.routes())
+}
+
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
+	r.Use(requestID)
+	r.Use(s.logRequests)
+	r.Use(s.writeErrors)
+	r.Use(s.recoverPanics)
+	r.Use(s.csrfMiddleware)
+
+	r.Get("/csrf-token", s.csrfTokenHandler)
+	r.Get("/verify-email", s.verifyEmailHandler) // ?token=
+
+	// Auth
+	r.Get("/auth/google", s.googleLoginHandler)
+	r.Get("/auth/google/callback", s.googleCallbackHandler)
+	r.Post("/auth/refresh", s.refreshTokenHandler)
+	r.Post("/auth/logout", s.logoutHandler)
+	r.Post("/auth/totp", s.totpLoginHandler) // second factor after Google or password sign-in
+	r.Post("/auth/login", s.passwordLoginHandler)
+	r.Post("/auth/forgot-password", s.forgotPasswordHandler)
+	r.Post("/auth/reset-password", s.resetPasswordHandler)
+
 	// Users
-	r.Post("/users", createUserHandler)
-	r.Get("/users", listUsersHandler)        // ?username=
-	r.Get("/users/{userId}", getUserHandler) // single user
+	r.Post("/users", s.createUserHandler)
+	r.With(s.rateLimit(s.usernameChecks)).Get("/users/available", s.usernameAvailableHandler) // ?username=
+	r.With(s.rateLimit(s.usernameChecks)).Post("/users/available", s.usernamesAvailableHandler)
+	r.Get("/users", s.listUsersHandler)            // ?username=
+	r.Get("/users/{userId}", s.getUserHandler)     // single user
+	r.Patch("/users/{userId}", s.patchUserHandler) // username change (rate limited)
+	r.Get("/users/{userId}/shared-with-me", s.listSharedDecksHandler)
+	r.Get("/users/{userId}/suggestions", s.deckSuggestionsHandler) // ?limit=
+	r.Get("/users/{userId}/similar", s.similarUsersHandler)        // reviewers of the same decks
+	r.Get("/recommendations", s.recommendationsHandler)            // ?userId=
+	r.Get("/users/{userId}/duplicates", s.duplicateCardsHandler)
+	r.Get("/users/{userId}/decks", s.listUserDecksHandler)            // ?orderBy=name|nextDue
+	r.Get("/users/{userId}/decks/largest", s.largestUserDecksHandler) // ?limit=
+	r.Get("/users/{userId}/decks/tree", s.deckTreeHandler)
+	r.Get("/users/{userId}/sessions", s.listSessionsHandler)
+	r.Delete("/users/{userId}/sessions", s.revokeAllSessionsHandler)
+	r.Delete("/users/{userId}/sessions/{sessionId}", s.revokeSessionHandler)
+	r.Post("/users/{userId}/totp/setup", s.totpSetupHandler)
+	r.Post("/users/{userId}/totp/verify", s.totpVerifyHandler)
+	r.Post("/users/{userId}/resend-verification", s.resendVerificationHandler)
+	r.Get("/users/{userId}/preferences", s.getPreferencesHandler)
+	r.Patch("/users/{userId}/preferences", s.updatePreferencesHandler)
+	r.Post("/users/{userId}/preferences", s.updatePreferencesHandler)
 
 	// Decks
-	r.Post("/decks", createDeckHandler)            // optionally with cards
-	r.Get("/decks", listDecksHandler)              // ?name=
-	r.Get("/decks/{deckId}", getDeckHandler)       // single deck
-	r.Patch("/decks/{deckId}", patchDeckHandler)   // partial update
-	r.Delete("/decks/{deckId}", deleteDeckHandler) // deletes cards via FK cascade
+	r.Post("/decks", s.createDeckHandler)                    // optionally with cards
+	r.Post("/decks/batch-update", s.batchUpdateDecksHandler) // ?userId=
+	r.Post("/decks/batch", s.batchGetDecksHandler)           // fetch by IDs
+	r.Get("/decks", s.listDecksHandler)                      // ?name=&tag=
+	r.Get("/decks/{deckId}", s.getDeckHandler)               // single deck
+	r.Get("/decks/by-slug/{slug}", s.getDeckBySlugHandler)
+	r.Patch("/decks/{deckId}", s.patchDeckHandler)   // partial update
+	r.Delete("/decks/{deckId}", s.deleteDeckHandler) // deletes cards via FK cascade
+	r.Get("/decks/{deckId}/export.md", s.exportDeckMarkdownHandler)
+	r.Post("/decks/import/markdown", s.importDeckMarkdownHandler) // ?userId=
+	r.Post("/decks/import/json", s.importDeckJSONHandler)         // ?userId=
+	r.Post("/decks/from-template", s.createDeckFromTemplateHandler)
+	r.Post("/deck-templates", s.createDeckTemplateHandler)
+	r.Get("/deck-templates/{templateId}", s.getDeckTemplateHandler)
+	r.Get("/users/{userId}/schedules.json", s.exportSchedulesHandler)
+	r.Post("/users/{userId}/schedules/import", s.importSchedulesHandler)
+	r.Get("/decks/{deckId}/audit", s.listDeckAuditHandler) // ?limit=
+	r.Get("/decks/{deckId}/growth", s.deckGrowthHandler)   // ?weeks=
+	r.Get("/decks/{deckId}/cards", s.listDeckCardsHandler) // ?studied=&difficulty=&flag=&flagged=&userId=&limit=&offset=
+	r.Patch("/decks/{deckId}/cards/reorder", s.reorderCardsHandler)
+
+	// Collaborators
+	r.Post("/decks/{deckId}/collaborators", s.addCollaboratorHandler)
+	r.Delete("/decks/{deckId}/collaborators/{userId}", s.removeCollaboratorHandler)
+
+	// Deck tags
+	r.Post("/decks/{deckId}/tags/{tag}", s.addDeckTagHandler)
+	r.Delete("/decks/{deckId}/tags/{tag}", s.removeDeckTagHandler)
+
+	// Collections (ordered groups of a user's decks)
+	r.Post("/collections", s.createCollectionHandler)
+	r.Get("/collections/{collectionId}", s.getCollectionHandler)
+	r.Patch("/collections/{collectionId}", s.patchCollectionHandler)
+	r.Delete("/collections/{collectionId}", s.deleteCollectionHandler)
+	r.Post("/collections/{collectionId}/decks", s.addCollectionDeckHandler)
+	r.Delete("/collections/{collectionId}/decks/{deckId}", s.removeCollectionDeckHandler)
+	r.Get("/collections/{collectionId}/study", s.collectionStudyHandler) // ?userId=&tz=
+
+	// Share links
+	r.Post("/decks/{deckId}/share-link", s.createShareLinkHandler)
+	r.Get("/s/{token}", s.followShareLinkHandler) // redirects to the deck
+
+	// Public decks
+	r.Get("/public/decks", s.listPublicDecksHandler)          // ?tag=&limit=&offset=
+	r.Get("/public/decks/recent", s.recentPublicDecksHandler) // ?limit=
+	r.Post("/public/decks/{deckId}/copy", s.copyPublicDeckHandler)
+	r.Post("/public/decks/{deckId}/report", s.reportPublicDeckHandler) // flag for moderation
+	r.Get("/public/cards/frequency", s.cardFrequencyHandler)           // ?front=
+	r.Get("/decks/{deckId}/embed", s.embedDeckHandler)                 // HTML widget snippet
 
 	// Cards
-	r.Post("/cards", createCardHandler)          // create card & assign deckId
-	r.Patch("/cards/{cardId}", patchCardHandler) // partial update
-	r.Delete("/cards/{cardId}", deleteCardHandler)
+	r.Post("/cards", s.createCardHandler) // create card & assign deckId
+	r.Post("/cards/batch-get", s.batchGetCardsHandler)
+	r.Post("/cards/batch", s.batchCardsHandler) // keyed by ID
+	r.Get("/cards/{cardId}", s.getCardHandler)  // ?lang=
+	r.Get("/cards/{cardId}/context", s.cardContextHandler)
+	r.Get("/cards/{cardId}/my-note", s.getMyNoteHandler) // bearer access token
+	r.Put("/cards/{cardId}/my-note", s.putMyNoteHandler)
+	r.Put("/cards/{cardId}/translations/{lang}", s.putCardTranslationHandler)
+	r.Patch("/cards/{cardId}", s.patchCardHandler) // partial update
+	r.Delete("/cards/{cardId}", s.deleteCardHandler)
+	r.Post("/cards/{cardId}/check", s.checkAnswerHandler) // grade a typed answer
 
-	fmt.Println("Server listening on :8080")
-	http.ListenAndServe(":8080", r)
+	// Reviews
+	r.Post("/cards/{cardId}/review", s.reviewCardHandler) // grade a card (SM-2)
+	r.Post("/cards/{cardId}/review/undo", s.undoReviewHandler)
+	r.Post("/cards/{cardId}/pin-due", s.pinDueHandler)              // teacher override, optional lock
+	r.Get("/cards/{cardId}/schedule", s.schedulePreviewHandler)     // ?userId=&reviews=
+	r.Get("/cards/{cardId}/review-preview", s.reviewPreviewHandler) // ?userId=
+	r.Get("/users/{userId}/calendar", s.studyCalendarHandler)       // ?year=&month=&tz=
+	r.Get("/users/{userId}/streak", s.streakHandler)                // ?tz=
+	r.Post("/users/{userId}/streak-shield", s.awardStreakShieldHandler)
+	r.Get("/decks/{deckId}/session-estimate", s.sessionEstimateHandler) // ?userId=
+	r.Post("/decks/{deckId}/simulate", s.simulateDeckHandler)           // projected daily review load
+	r.Get("/decks/{deckId}/progress", s.deckProgressHandler)            // ?userId=
+	r.Get("/decks/{deckId}/eta", s.deckETAHandler)                      // ?userId=&tz=
+	r.Get("/decks/{deckId}/overdue", s.overdueCardsHandler)             // ?userId=&limit=&offset=
+	r.Get("/study/next", s.nextStudyCardHandler)                        // ?userId=&deckId=|collectionId=
+	r.Post("/study/bulk-review", s.bulkReviewHandler)
+	r.Post("/study/offline-token", s.offlineTokenHandler) // ?userId=&deckId=
+	r.Get("/users/{userId}/cram", s.cramHandler)          // ?limit=&deckIds=a,b
+
+	// Teacher and admin views outside /admin (bearer ADMIN_TOKEN)
+	r.With(s.requireAdmin).Get("/decks/{deckId}/compare", s.compareDeckHandler)        // ?users=a,b,c
+	r.With(s.requireAdmin).Get("/users/{userId}/login-history", s.loginHistoryHandler) // ?limit=&offset=
+
+	// Admin (bearer ADMIN_TOKEN)
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(s.requireAdmin)
+		r.Get("/flagged-cards", s.listFlaggedCardsHandler)  // ?flag=&limit=&offset=
+		r.Post("/integrity-check", s.integrityCheckHandler) // ?fix=true
+		r.Get("/backup", s.backupHandler)
+		r.Post("/users/merge", s.mergeUsersHandler)
+		r.Get("/reviews", s.listReviewsHandler)     // ?userId=&deckId=&date=&limit=&offset=
+		r.Get("/reports", s.listDeckReportsHandler) // ?deckId=&limit=&offset=
+	})
+
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+
+	return r
+}
+
+// waitForDB pings the database until it answers, backing off exponentially
+// between attempts. It gives up after maxAttempts pings or once maxWait has
+// elapsed, whichever comes first.
+func (s *Server) waitForDB(ctx context.Context, maxAttempts int, maxWait time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	backoff := 200 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = s.db.PingContext(ctx); err == nil {
+			if attempt > 1 {
+				s.logger.Info("db ready", "attempts", attempt)
+			}
+			return nil
+		}
+		s.logger.Warn("db ping failed", "attempt", attempt, "maxAttempts", maxAttempts, "err", err)
+		if attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", maxAttempts, err)
+}
+
+// checkForeignKeys fails if foreign key enforcement is off, which happens
+// silently when the driver ignores the DSN flag and the pragma. Existing
+// violations are logged per table; they are only an error with
+// STRICT_FOREIGN_KEYS; see also POST /admin/integrity-check.
+func (s *Server) checkForeignKeys() error {
+	var enabled bool
+	if err := s.db.QueryRow(`PRAGMA foreign_keys`).Scan(&enabled); err != nil {
+		return err
+	}
+	if !enabled {
+		return errors.New("enforcement is off; the sqlite driver ignored _foreign_keys=on and PRAGMA foreign_keys = ON")
+	}
+	rows, err := s.db.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type ref struct{ table, parent string }
+	counts := map[ref]int{}
+	var order []ref
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		k := ref{table, parent}
+		if counts[k] == 0 {
+			order = append(order, k)
+		}
+		counts[k]++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	total := 0
+	for _, k := range order {
+		s.logger.Warn("foreign key violations", "table", k.table, "parent", k.parent, "rows", counts[k])
+		total += counts[k]
+	}
+	if total > 0 && s.config.StrictForeignKeys {
+		return fmt.Errorf("%d rows violate foreign keys", total)
+	}
+	return nil
 }
 
 func runMigrations(db *sql.DB) error {
@@ -107,422 +506,9017 @@ CREATE TABLE IF NOT EXISTS cards (
     back TEXT NOT NULL,
     FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS tags (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS card_tags (
+    card_id TEXT NOT NULL,
+    tag_id TEXT NOT NULL,
+    PRIMARY KEY (card_id, tag_id),
+    FOREIGN KEY (card_id) REFERENCES cards(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+-- Tags on a whole deck; they share the tags table with card tags.
+CREATE TABLE IF NOT EXISTS deck_tags (
+    deck_id TEXT NOT NULL,
+    tag_id TEXT NOT NULL,
+    PRIMARY KEY (deck_id, tag_id),
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS deck_collaborators (
+    deck_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('viewer', 'editor')),
+    PRIMARY KEY (deck_id, user_id),
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS card_schedules (
+    card_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    ease_factor REAL NOT NULL DEFAULT 2.5,
+    interval_days INTEGER NOT NULL DEFAULT 0,
+    repetitions INTEGER NOT NULL DEFAULT 0,
+    due_at TEXT NOT NULL,
+    last_reviewed_at TEXT,
+    PRIMARY KEY (card_id, user_id),
+    FOREIGN KEY (card_id) REFERENCES cards(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS review_log (
+    id TEXT PRIMARY KEY,
+    card_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    quality INTEGER NOT NULL,
+    reviewed_at TEXT NOT NULL,
+    duration_ms INTEGER,
+    interval_before INTEGER NOT NULL,
+    ease_before REAL NOT NULL,
+    repetitions_before INTEGER NOT NULL,
+    due_before TEXT,
+    interval_after INTEGER NOT NULL,
+    ease_after REAL NOT NULL,
+    FOREIGN KEY (card_id) REFERENCES cards(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_review_log_user_time ON review_log(user_id, reviewed_at);
+
+CREATE TABLE IF NOT EXISTS deck_audit (
+    id TEXT PRIMARY KEY,
+    deck_id TEXT NOT NULL,
+    user_id TEXT,
+    action TEXT NOT NULL,
+    detail TEXT,
+    created_at TEXT NOT NULL,
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_deck_audit_deck_time ON deck_audit(deck_id, created_at);
+
+CREATE TABLE IF NOT EXISTS card_translations (
+    card_id TEXT NOT NULL,
+    lang_code TEXT NOT NULL,
+    field TEXT NOT NULL CHECK(field IN ('front','back')),
+    content TEXT NOT NULL,
+    PRIMARY KEY (card_id, lang_code, field),
+    FOREIGN KEY (card_id) REFERENCES cards(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS streak_shield_days (
+    user_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    PRIMARY KEY (user_id, day),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Runtime settings that triggers need to read.
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS share_links (
+    token TEXT PRIMARY KEY,
+    deck_id TEXT NOT NULL,
+    created_by TEXT,
+    expires_at TEXT,
+    uses_remaining INTEGER,
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS login_history (
+    id TEXT PRIMARY KEY,
+    user_id TEXT,
+    ip TEXT,
+    success INTEGER NOT NULL,
+    created_at TEXT NOT NULL,
+    user_agent TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_history_user_time ON login_history(user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS totp_backup_codes (
+    user_id TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+    user_id TEXT PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    used_at TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS deck_reports (
+    id TEXT PRIMARY KEY,
+    deck_id TEXT NOT NULL,
+    reporter_user_id TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    UNIQUE (deck_id, reporter_user_id),
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE,
+    FOREIGN KEY (reporter_user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS deck_templates (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    field_names TEXT NOT NULL, -- JSON array of strings
+    front_template TEXT NOT NULL,
+    back_template TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+    user_id TEXT PRIMARY KEY,
+    hint_delay_seconds INTEGER NOT NULL DEFAULT 10,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS collections (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT,
+    created_at TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS collection_decks (
+    collection_id TEXT NOT NULL,
+    deck_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (collection_id, deck_id),
+    FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+    FOREIGN KEY (deck_id) REFERENCES decks(id) ON DELETE CASCADE
+);
+
+-- Private notes a user keeps on any card they study, shared deck or not.
+CREATE TABLE IF NOT EXISTS card_notes (
+    card_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    note TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    PRIMARY KEY (card_id, user_id),
+    FOREIGN KEY (card_id) REFERENCES cards(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    refresh_token_hash TEXT NOT NULL UNIQUE,
+    device_name TEXT NOT NULL,
+    ip_address TEXT,
+    created_at TEXT NOT NULL,
+    last_used_at TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (refresh_token_hash) REFERENCES refresh_tokens(token_hash) ON DELETE CASCADE
+);
 `
-	_, err := db.Exec(schema)
-	return err
-}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
 
-func ensureInitialUser() error {
-	_, err := db.Exec(`INSERT OR IGNORE INTO users(id, username) VALUES (?, ?)`, "0", "initial_user")
-	return err
-}
+	// Columns added after the initial schema; CREATE TABLE IF NOT EXISTS
+	// won't add them to an existing database.
+	if err := ensureColumn(db, "users", "username_changed_at", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "timezone", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "streak_shields", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "streak_shield_awarded_on", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "slug", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "is_public", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "copied_from", "TEXT REFERENCES decks(id) ON DELETE SET NULL"); err != nil {
+		return err
+	}
+	// Nested decks. Deleting a parent lifts its children to the top level.
+	if err := ensureColumn(db, "decks", "parent_id", "TEXT REFERENCES decks(id) ON DELETE SET NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "case_sensitive", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "archived", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "decks", "default_side", "TEXT NOT NULL DEFAULT 'front'"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "card_schedules", "locked", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "cards", "flag", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "cards", "updated_at", "TEXT"); err != nil {
+		return err
+	}
+	// Content edits are stamped so offline study tokens can spot stale cards.
+	if _, err := db.Exec(`CREATE TRIGGER IF NOT EXISTS cards_updated_at AFTER UPDATE OF front, back ON cards
+BEGIN
+    UPDATE cards SET updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now') WHERE id = NEW.id;
+END`); err != nil {
+		return err
+	}
+	// Inserts past the configured per-deck limit fail; see setCardLimit.
+	if _, err := db.Exec(`CREATE TRIGGER IF NOT EXISTS cards_limit BEFORE INSERT ON cards
+WHEN (SELECT COUNT(*) FROM cards WHERE deck_id = NEW.deck_id) >=
+     (SELECT CAST(value AS INTEGER) FROM settings WHERE key = 'max_cards_per_deck')
+BEGIN
+    SELECT RAISE(ABORT, 'deck card limit exceeded');
+END`); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "cards", "position", "INTEGER"); err != nil {
+		return err
+	}
+	// New cards go to the end of their deck; existing ones keep insertion order.
+	if _, err := db.Exec(`CREATE TRIGGER IF NOT EXISTS cards_position AFTER INSERT ON cards
+WHEN NEW.position IS NULL
+BEGIN
+    UPDATE cards SET position = (SELECT COALESCE(MAX(position), -1) + 1 FROM cards WHERE deck_id = NEW.deck_id AND id != NEW.id)
+    WHERE id = NEW.id;
+END`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE cards SET position = (SELECT COUNT(*) FROM cards c2 WHERE c2.deck_id = cards.deck_id AND c2.rowid < cards.rowid)
+WHERE position IS NULL`); err != nil {
+		return err
+	}
+	// ALTER TABLE can't add a UNIQUE column, so uniqueness lives in an index.
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_decks_slug ON decks(slug)`); err != nil {
+		return err
+	}
+	if err := backfillDeckSlugs(db); err != nil {
+		return err
+	}
+	// A user's decks have distinct names. Older databases may hold
+	// duplicates, which are renamed before the index is built.
+	if err := dedupeDeckNames(db); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_decks_user_name ON decks(user_id, name)`); err != nil {
+		return err
+	}
 
-/* ---------- Helpers ---------- */
+	// Google sign-in. Like slugs, uniqueness lives in an index.
+	if err := ensureColumn(db, "users", "google_sub", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_google_sub ON users(google_sub)`); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "locked_until", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "totp_secret", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "email", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "email_verified", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "password_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "cards", "hint", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "cards", "images", "TEXT"); err != nil { // JSON array of URLs
+		return err
+	}
+	if err := ensureColumn(db, "user_preferences", "new_cards_per_day", "INTEGER NOT NULL DEFAULT 20"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "user_preferences", "review_limit", "INTEGER NOT NULL DEFAULT 100"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "user_preferences", "interface_language", "TEXT"); err != nil {
+		return err
+	}
 
-func respondJSON(w http.ResponseWriter, code int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if v == nil {
-		return
+	// Creation timestamps. ALTER TABLE can't add a column with a
+	// non-constant default, so triggers stamp new rows instead. Rows that
+	// predate the column keep a NULL created_at.
+	for _, table := range []string{"decks", "cards"} {
+		if err := ensureColumn(db, table, "created_at", "TEXT"); err != nil {
+			return err
+		}
+		trigger := fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_created_at AFTER INSERT ON %[1]s
+WHEN NEW.created_at IS NULL
+BEGIN
+    UPDATE %[1]s SET created_at = strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', 'now') WHERE id = NEW.id;
+END`, table)
+		if _, err := db.Exec(trigger); err != nil {
+			return err
+		}
 	}
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(v)
+	return nil
 }
 
-func respondError(w http.ResponseWriter, code int, msg string) {
-	respondJSON(w, code, map[string]string{"error": msg})
+// setCardLimit stores the per-deck card limit read by the cards_limit
+// trigger. A limit of 0 removes it.
+func setCardLimit(db *sql.DB, limit int) error {
+	if limit <= 0 {
+		_, err := db.Exec(`DELETE FROM settings WHERE key = 'max_cards_per_deck'`)
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO settings (key, value) VALUES ('max_cards_per_deck', ?)
+ON CONFLICT(key) DO UPDATE SET value = excluded.value`, strconv.Itoa(limit))
+	return err
 }
 
-func genID() string {
-	return uuid.New().String()
+// isCardLimitError reports whether err came from the cards_limit trigger.
+func isCardLimitError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "deck card limit exceeded")
 }
 
-/* ---------- Handlers: Users ---------- */
+// isDeckNameConflict reports whether err came from idx_decks_user_name.
+func isDeckNameConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: decks.user_id, decks.name")
+}
 
-// POST /users
-// body: { "username": "..." }
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Username string `json:"username"`
+// dedupeDeckNames renames all but the oldest of a user's same-named decks
+// to "name (2)", "name (3)", ..., the way merging users does.
+func dedupeDeckNames(db *sql.DB) error {
+	type deckRow struct{ id, userID, name string }
+	rows, err := db.Query(`SELECT id, user_id, name FROM decks ORDER BY rowid`)
+	if err != nil {
+		return err
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid json")
+	defer rows.Close()
+	var decks []deckRow
+	taken := map[[2]string]bool{}
+	for rows.Next() {
+		var d deckRow
+		if err := rows.Scan(&d.id, &d.userID, &d.name); err != nil {
+			return err
+		}
+		decks = append(decks, d)
+		taken[[2]string{d.userID, d.name}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	seen := map[[2]string]bool{}
+	for _, d := range decks {
+		if key := [2]string{d.userID, d.name}; !seen[key] {
+			seen[key] = true
+			continue
+		}
+		name := d.name
+		for n := 2; taken[[2]string{d.userID, name}]; n++ {
+			name = fmt.Sprintf("%s (%d)", d.name, n)
+		}
+		taken[[2]string{d.userID, name}] = true
+		seen[[2]string{d.userID, name}] = true
+		if _, err := db.Exec(`UPDATE decks SET name = ? WHERE id = ?`, name, d.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// availableDeckName returns name, or name with the first free " (n)" suffix
+// if the user already has a deck called that.
+func availableDeckName(tx *sql.Tx, userID, name string) (string, error) {
+	candidate := name
+	for n := 2; ; n++ {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM decks WHERE user_id = ? AND name = ?)`, userID, candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)", name, n)
+	}
+}
+
+// backfillDeckSlugs assigns slugs to decks created before the slug column existed.
+func backfillDeckSlugs(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, name FROM decks WHERE slug IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	names := map[string]string{}
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		names[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	for id, name := range names {
+		if err := insertWithSlug(name, id, func(slug string) error {
+			_, err := db.Exec(`UPDATE decks SET slug = ? WHERE id = ?`, slug, id)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds column to table unless it already exists.
+func ensureColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+func (s *Server) ensureInitialUser() error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO users(id, username) VALUES (?, ?)`, "0", "initial_user")
+	return err
+}
+
+/* ---------- Middleware ---------- */
+
+// requestIDPattern limits which client-supplied X-Request-ID values are echoed back.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID sets X-Request-ID on the response, reusing the client's value
+// when it looks sane and generating one otherwise.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unloggedPaths are GET endpoints polled often enough that logging them is
+// just noise.
+var unloggedPaths = map[string]bool{"/healthz": true, "/metrics": true}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter { return sr.ResponseWriter }
+
+// logRequests logs one line per request once it has been served. It runs
+// after requestID so the ID is already on the response.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && unloggedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.logger.Info("request",
+			"requestId", w.Header().Get("X-Request-ID"),
+			"clientIp", realClientIP(r, s.config.TrustedProxies),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"status", rec.status,
+			"durationMs", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// writeErrors gives each request a slot for setError and, once the handler
+// returns, writes the recorded error as JSON. This is the single place error
+// responses are formatted.
+func (s *Server) writeErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slot := &errorSlot{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorSlotKey{}, slot)))
+		if e := slot.err; e != nil {
+			body := map[string]interface{}{"code": string(e.Code)}
+			for k, v := range e.Details {
+				body[k] = v
+			}
+			if s.config.Envelope {
+				body["message"] = e.Msg
+				s.writeJSON(w, e.Status, map[string]interface{}{"error": body})
+				return
+			}
+			body["error"] = e.Msg
+			s.writeJSON(w, e.Status, body)
+		}
+	})
+}
+
+// recoverPanics turns a panicking handler into a logged 500 instead of
+// taking down the process.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// Deliberate abort; let net/http handle it.
+				panic(rec)
+			}
+			s.logger.Error("panic in handler",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()),
+			)
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfCookie holds the token issued by GET /csrf-token.
+const csrfCookie = "csrf_token"
+
+// csrfKey derives the CSRF signing key so it differs from the one used for
+// offline study tokens.
+func (s *Server) csrfKey() []byte {
+	mac := hmac.New(sha256.New, s.config.StudyTokenSecret)
+	mac.Write([]byte("csrf"))
+	return mac.Sum(nil)
+}
+
+// csrfSignature is the base64url HMAC of a token's random part.
+func (s *Server) csrfSignature(nonce string) string {
+	mac := hmac.New(sha256.New, s.csrfKey())
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether token was issued by this server.
+func (s *Server) validCSRFToken(token string) bool {
+	nonce, sig, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(sig), []byte(s.csrfSignature(nonce)))
+}
+
+// csrfMiddleware enforces the double-submit check when
+// Config.CSRFProtection is on: unsafe requests need an X-CSRF-Token header
+// equal to the signed csrf_token cookie. Requests with a bearer token are
+// API clients, which don't rely on cookies, and skip the check.
+func (s *Server) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !s.config.CSRFProtection,
+			r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions,
+			strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := r.Cookie(csrfCookie)
+		header := r.Header.Get("X-CSRF-Token")
+		if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(c.Value)) != 1 || !s.validCSRFToken(c.Value) {
+			setError(r.Context(), AppError{Code: ErrCodeCSRF, Status: http.StatusForbidden, Msg: "missing or invalid CSRF token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin only lets through requests bearing Config.AdminToken. With
+// no token configured, the admin API is off entirely.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken == "" {
+			setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "admin API disabled"})
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "admin token required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdminRequest reports whether r carries Config.AdminToken, for the few
+// user endpoints an admin may also act on.
+func (s *Server) isAdminRequest(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+// rateLimiter allows up to limit requests per key in each fixed window.
+// Counts for every key are dropped together when a window ends, so memory
+// stays bounded by the keys seen in one window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: map[string]int{}}
+}
+
+// allow records a request for key and reports whether it is within the
+// limit; if not, it also returns how long until the window resets.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		clear(l.counts)
+	}
+	if l.counts[key] >= l.limit {
+		return false, l.start.Add(l.window).Sub(now)
+	}
+	l.counts[key]++
+	return true, 0
+}
+
+// rateLimit rejects requests from a client IP over l's limit with 429 and
+// Retry-After. A limit of 0 turns it off.
+func (s *Server) rateLimit(l *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l.limit > 0 {
+				if ok, wait := l.allow(realClientIP(r, s.config.TrustedProxies), time.Now()); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					setError(r.Context(), AppError{Code: ErrCodeRateLimited, Status: http.StatusTooManyRequests, Msg: "too many requests; slow down"})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// notFoundHandler answers requests that match no route. It runs inside the
+// router's middleware, so the error is written as JSON by writeErrors.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	setError(r.Context(), AppError{Code: ErrCodeNotFound, Status: http.StatusNotFound, Msg: "no route for " + r.URL.Path})
+}
+
+// methodNotAllowedHandler answers requests whose path exists under other
+// methods. chi only fills in the Allow header for its own default handler, so
+// it is rebuilt here by probing the root router, which also descends into
+// mounted subrouters.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.Routes != nil {
+		for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+			if rctx.Routes.Match(chi.NewRouteContext(), m, r.URL.Path) {
+				w.Header().Add("Allow", m)
+			}
+		}
+	}
+	setError(r.Context(), AppError{Code: ErrCodeMethodNotAllowed, Status: http.StatusMethodNotAllowed, Msg: r.Method + " not allowed on " + r.URL.Path})
+}
+
+/* ---------- Helpers ---------- */
+
+// envelope is the success shape used when Config.Envelope is on.
+type envelope struct {
+	Data interface{}  `json:"data"`
+	Meta envelopeMeta `json:"meta"`
+}
+
+type envelopeMeta struct {
+	RequestID string `json:"requestId"`
+}
+
+// respondJSON writes a success payload, wrapped in an envelope if enabled.
+func (s *Server) respondJSON(w http.ResponseWriter, code int, v interface{}) {
+	if s.config.Envelope && v != nil && code < 400 {
+		v = envelope{Data: v, Meta: envelopeMeta{RequestID: w.Header().Get("X-Request-ID")}}
+	}
+	s.writeJSON(w, code, v)
+}
+
+// writeJSON writes v as-is.
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if v == nil {
+		return
+	}
+	enc := json.NewEncoder(w)
+	if s.config.PrettyJSON {
+		enc.SetIndent("", "  ")
+	}
+	_ = enc.Encode(v)
+}
+
+// errEmptyBody is returned by decodeJSON when the request has no body. PATCH
+// handlers ignore it and report "no fields to update" instead.
+var errEmptyBody = errors.New("request body is empty")
+
+// decodeJSON decodes the request body into v. The returned error's message is
+// safe to send to the client, e.g. "field 'name' must be a string".
+func decodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return errEmptyBody
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Errorf("field '%s' must be %s", typeErr.Field, jsonTypeName(typeErr.Type))
+	default:
+		return errors.New("invalid json")
+	}
+}
+
+// jsonTypeName describes a Go type the way a JSON client would think of it.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// ErrorCode is the stable, machine-readable "code" in error responses.
+// Clients branch on these, so existing values must not change.
+type ErrorCode string
+
+const (
+	ErrCodeValidation           ErrorCode = "validation_failed"
+	ErrCodeInvalidBody          ErrorCode = "invalid_body"
+	ErrCodeInvalidReference     ErrorCode = "INVALID_REFERENCE" // published uppercase before the other codes
+	ErrCodeForbidden            ErrorCode = "forbidden"
+	ErrCodeUnauthorized         ErrorCode = "unauthorized"
+	ErrCodeInternal             ErrorCode = "internal_error"
+	ErrCodeUserNotFound         ErrorCode = "user_not_found"
+	ErrCodeUsernameTaken        ErrorCode = "username_taken"
+	ErrCodeUsernameCooldown     ErrorCode = "username_change_cooldown"
+	ErrCodeDeckNotFound         ErrorCode = "deck_not_found"
+	ErrCodeDeckNotPublic        ErrorCode = "deck_not_public"
+	ErrCodeCardNotFound         ErrorCode = "card_not_found"
+	ErrCodeCollaboratorNotFound ErrorCode = "collaborator_not_found"
+	ErrCodeShareLinkNotFound    ErrorCode = "share_link_not_found"
+	ErrCodeShareLinkExpired     ErrorCode = "share_link_expired"
+	ErrCodeShareLinkExhausted   ErrorCode = "share_link_exhausted"
+	ErrCodeReviewNotFound       ErrorCode = "review_not_found"
+	ErrCodeUndoWindowExpired    ErrorCode = "undo_window_expired"
+	ErrCodePositionConflict     ErrorCode = "position_conflict"
+	ErrCodeNotFound             ErrorCode = "not_found"
+	ErrCodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	ErrCodeDeckCardLimit        ErrorCode = "deck_card_limit_exceeded"
+	ErrCodeCSRF                 ErrorCode = "csrf_token_invalid"
+	ErrCodeAccountLocked        ErrorCode = "account_locked"
+	ErrCodeTOTPEnabled          ErrorCode = "totp_already_enabled"
+	ErrCodeTOTPNotSetUp         ErrorCode = "totp_not_set_up"
+	ErrCodeTOTPInvalid          ErrorCode = "totp_code_invalid"
+	ErrCodeEmailUnverified      ErrorCode = "email_not_verified"
+	ErrCodeEmailVerified        ErrorCode = "email_already_verified"
+	ErrCodeAlreadyReported      ErrorCode = "already_reported"
+	ErrCodeDeckNameTaken        ErrorCode = "deck_name_taken"
+	ErrCodeTemplateNotFound     ErrorCode = "template_not_found"
+	ErrCodeTagNotFound          ErrorCode = "tag_not_found"
+	ErrCodeCollectionNotFound   ErrorCode = "collection_not_found"
+	ErrCodeNoteNotFound         ErrorCode = "note_not_found"
+	ErrCodeRateLimited          ErrorCode = "rate_limited"
+	ErrCodeResetTokenInvalid    ErrorCode = "reset_token_invalid"
+)
+
+// AppError is an error response: HTTP status, machine-readable code and
+// human-readable message. Details are extra machine-readable fields written
+// next to code, for clients that shouldn't have to parse the message.
+type AppError struct {
+	Code    ErrorCode
+	Status  int
+	Msg     string
+	Details map[string]interface{}
+}
+
+func (e AppError) Error() string { return e.Msg }
+
+type errorSlotKey struct{}
+
+// errorSlot holds the error a handler reported via setError.
+type errorSlot struct {
+	err *AppError
+}
+
+// setError records e as the response for the current request; the handler
+// should return right after. writeErrors renders it.
+func setError(ctx context.Context, e AppError) {
+	slot, ok := ctx.Value(errorSlotKey{}).(*errorSlot)
+	if !ok {
+		slog.Error("setError called outside writeErrors middleware", "code", e.Code, "msg", e.Msg)
+		return
+	}
+	slot.err = &e
+}
+
+// withTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise. fn can return an AppError to have it reported as-is; see
+// setTxError.
+func (s *Server) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setTxError reports an error returned by withTx: AppErrors are passed
+// through, anything else becomes a 500.
+func setTxError(ctx context.Context, err error) {
+	var ae AppError
+	if errors.As(err, &ae) {
+		setError(ctx, ae)
+		return
+	}
+	if isCardLimitError(err) {
+		setError(ctx, AppError{Code: ErrCodeDeckCardLimit, Status: http.StatusUnprocessableEntity, Msg: "deck card limit exceeded"})
+		return
+	}
+	if isDeckNameConflict(err) {
+		setError(ctx, AppError{Code: ErrCodeDeckNameTaken, Status: http.StatusConflict, Msg: "user already has a deck with this name"})
+		return
+	}
+	setError(ctx, AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+}
+
+func genID() string {
+	return uuid.New().String()
+}
+
+// deckSlug builds a URL-friendly slug from a deck name, suffixed with the
+// first 4 characters of the deck ID. That alone doesn't make it unique; see
+// insertWithSlug.
+func deckSlug(name, deckID string) string {
+	suffix := deckID
+	if len(suffix) > 4 {
+		suffix = suffix[:4]
+	}
+	return slugWithSuffix(name, suffix)
+}
+
+// slugWithSuffix is deckSlug with an arbitrary suffix.
+func slugWithSuffix(name, suffix string) string {
+	var b strings.Builder
+	for _, r := range strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "-") {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return suffix
+	}
+	return b.String() + "-" + suffix
+}
+
+// slugRetries is how many times insertWithSlug retries after a slug collision.
+const slugRetries = 5
+
+// insertWithSlug runs insert, a deck INSERT or a slug backfill UPDATE, with
+// deckSlug(name, deckID). Slugs share one global index and a four-character
+// suffix, so popular names collide; on a collision insert is retried with a
+// random twelve-character suffix.
+func insertWithSlug(name, deckID string, insert func(slug string) error) error {
+	err := insert(deckSlug(name, deckID))
+	for i := 0; i < slugRetries && isSlugConflict(err); i++ {
+		err = insert(slugWithSuffix(name, strings.ReplaceAll(genID(), "-", "")[:12]))
+	}
+	return err
+}
+
+// isSlugConflict reports whether err came from idx_decks_slug.
+func isSlugConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: decks.slug")
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// randomBase58 returns n cryptographically random base58 characters.
+func randomBase58(n int) (string, error) {
+	max := big.NewInt(int64(len(base58Alphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = base58Alphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// publicBaseURL is the externally visible origin used in generated links.
+// Config.PublicBaseURL overrides the one inferred from the request.
+func (s *Server) publicBaseURL(r *http.Request) string {
+	if s.config.PublicBaseURL != "" {
+		return s.config.PublicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// placeholders returns n comma-separated SQL placeholders for an IN clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Page is a slice of results plus what's needed to fetch the next one.
+type Page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// parsePagination reads ?limit= (default 50, max 200) and ?offset=.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		limit = min(limit, 200)
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// envString reads an environment variable, falling back to def when unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a time.ParseDuration environment variable, falling back to def when unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("invalid duration in environment, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+// envBool reads a strconv.ParseBool environment variable, falling back to def when unset or invalid.
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("invalid bool in environment, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer environment variable, falling back to def when unset or invalid.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("invalid integer in environment, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envIPs parses a comma-separated list of IPs, skipping invalid entries.
+func envIPs(key string) []net.IP {
+	var ips []net.IP
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			slog.Warn("invalid IP in environment, ignoring", "key", key, "value", v)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// isTrustedProxy reports whether ip is one of trustedProxies.
+func isTrustedProxy(ip net.IP, trustedProxies []net.IP) bool {
+	for _, p := range trustedProxies {
+		if p.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the IP of the peer that sent r, without the port.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// realClientIP is the client's IP. X-Forwarded-For is only believed when the
+// request comes from a trusted proxy; it is read right to left, skipping
+// further trusted proxies, so a client can't spoof it by sending its own.
+func realClientIP(r *http.Request, trustedProxies []net.IP) string {
+	peer := remoteIP(r)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer.String()
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip, trustedProxies) {
+			return ip.String()
+		}
+	}
+	return peer.String()
+}
+
+// isHTTPS reports whether the client reached us over TLS, either directly or
+// via a trusted proxy that says so in X-Forwarded-Proto.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return r.Header.Get("X-Forwarded-Proto") == "https" && isTrustedProxy(remoteIP(r), s.config.TrustedProxies)
+}
+
+/* ---------- Handlers: CSRF ---------- */
+
+// GET /csrf-token
+// Issues a token as a cookie and in the body; browser clients echo the body
+// value in X-CSRF-Token on POST/PUT/PATCH/DELETE.
+func (s *Server) csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, err := randomBase58(32)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+		return
+	}
+	token := nonce + "." + s.csrfSignature(nonce)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	s.respondJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+/* ---------- Handlers: Auth ---------- */
+
+// Access tokens are short-lived; clients trade a refresh token for a new
+// one via POST /auth/refresh until the refresh token expires or is revoked.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// oauthStateCookie carries the state parameter between /auth/google and its
+// callback so a forged callback can't log someone into another account.
+const oauthStateCookie = "oauth_state"
+
+// googleUserInfoURL is Google's OpenID Connect userinfo endpoint.
+const googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+
+// AuthClaims is the payload of a login token.
+type AuthClaims struct {
+	Subject   string `json:"sub"` // user ID
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueAccessToken returns a signed access token for userID.
+func (s *Server) issueAccessToken(userID string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	exp := now.Add(accessTokenTTL)
+	token, err := signJWT(AuthClaims{Subject: userID, IssuedAt: now.Unix(), ExpiresAt: exp.Unix()}, s.config.AuthTokenSecret)
+	return token, exp, err
+}
+
+// bearerUserID returns the user named by the request's access token, or ""
+// when there is no bearer token. An invalid or expired token, or a token
+// minted for another purpose such as MFA, is an error.
+func (s *Server) bearerUserID(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", nil
+	}
+	var claims struct {
+		AuthClaims
+		Purpose string `json:"purpose"`
+	}
+	if err := verifyJWT(token, s.config.AuthTokenSecret, &claims); err != nil {
+		return "", err
+	}
+	if claims.Purpose != "" || claims.Subject == "" {
+		return "", errors.New("not an access token")
+	}
+	return claims.Subject, nil
+}
+
+// issueRefreshToken creates a refresh token for userID, and a session
+// recording the device r came from. Only the token's hash is stored, so a
+// leaked database doesn't leak usable tokens.
+func (s *Server) issueRefreshToken(r *http.Request, userID string) (string, time.Time, error) {
+	token, err := randomBase58(44)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	hash := hashToken(token)
+	now := time.Now().UTC()
+	exp := now.Add(refreshTokenTTL)
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO refresh_tokens(token_hash, user_id, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+			hash, userID, exp.Format(time.RFC3339), now.Format(time.RFC3339)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO user_sessions(id, user_id, refresh_token_hash, device_name, ip_address, created_at, last_used_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`, genID(), userID, hash, deviceName(r.UserAgent()), realClientIP(r, s.config.TrustedProxies),
+			now.Format(time.RFC3339), now.Format(time.RFC3339))
+		return err
+	})
+	return token, exp, err
+}
+
+// hashToken is how refresh tokens and TOTP backup codes are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenPair is returned on sign-in: an access token for requests and a
+// refresh token for getting the next one.
+type TokenPair struct {
+	Token            string `json:"token"`
+	ExpiresAt        string `json:"expiresAt"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt string `json:"refreshExpiresAt"`
+	User             User   `json:"user"`
+}
+
+// POST /auth/refresh
+// body: { "refreshToken": "..." }
+// Issues a new access token. The refresh token itself is unchanged.
+func (s *Server) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.RefreshToken == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "refreshToken required"})
+		return
+	}
+	var userID string
+	err := s.db.QueryRow(`SELECT user_id FROM refresh_tokens WHERE token_hash = ? AND expires_at > ?`,
+		hashToken(req.RefreshToken), time.Now().UTC().Format(time.RFC3339)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid or expired refresh token"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if _, err := s.db.Exec(`UPDATE user_sessions SET last_used_at = ?, ip_address = ? WHERE refresh_token_hash = ?`,
+		time.Now().UTC().Format(time.RFC3339), realClientIP(r, s.config.TrustedProxies), hashToken(req.RefreshToken)); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	token, exp, err := s.issueAccessToken(userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"token":     token,
+		"expiresAt": exp.Format(time.RFC3339),
+	})
+}
+
+// POST /auth/logout
+// body: { "refreshToken": "..." }
+// Revokes the refresh token, ending its session. Access tokens already issued stay valid until
+// they expire. Unknown tokens are not an error, so logout can be retried.
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.RefreshToken == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "refreshToken required"})
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE token_hash = ?`, hashToken(req.RefreshToken)); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cleanupRefreshTokens deletes expired refresh tokens, and with them their
+// sessions, every interval until ctx is cancelled.
+func (s *Server) cleanupRefreshTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE expires_at <= ?`, time.Now().UTC().Format(time.RFC3339))
+			if err != nil {
+				s.logger.Error("refresh token cleanup failed", "err", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				s.logger.Info("refresh token cleanup", "removed", n)
+			}
+		}
+	}
+}
+
+// googleOAuth returns the OAuth2 client config, or nil when Google sign-in
+// isn't configured. Without GOOGLE_REDIRECT_URL the callback URL is derived
+// from the request.
+func (s *Server) googleOAuth(r *http.Request) *oauth2.Config {
+	if s.config.GoogleClientID == "" {
+		return nil
+	}
+	redirect := s.config.GoogleRedirectURL
+	if redirect == "" {
+		redirect = s.publicBaseURL(r) + "/auth/google/callback"
+	}
+	return &oauth2.Config{
+		ClientID:     s.config.GoogleClientID,
+		ClientSecret: s.config.GoogleClientSecret,
+		Endpoint:     endpoints.Google,
+		RedirectURL:  redirect,
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+}
+
+// GET /auth/google
+// Redirects to Google's consent screen.
+func (s *Server) googleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	conf := s.googleOAuth(r)
+	if conf == nil {
+		setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "Google sign-in disabled"})
+		return
+	}
+	state, err := randomBase58(32)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate state"})
+		return
+	}
+	// Lax, not Strict: the callback is a top-level navigation from Google.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth/google",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   s.isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, conf.AuthCodeURL(state), http.StatusFound)
+}
+
+// GET /auth/google/callback?code=&state=
+// Exchanges the code, looks the user up by their Google subject (creating
+// them on first sign-in) and returns a token pair.
+func (s *Server) googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	conf := s.googleOAuth(r)
+	if conf == nil {
+		setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "Google sign-in disabled"})
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		s.recordLogin(r, "", false)
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "Google sign-in failed: " + e})
+		return
+	}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || q.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(q.Get("state"))) != 1 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid or missing state"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/google", MaxAge: -1})
+	if q.Get("code") == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "code required"})
+		return
+	}
+
+	tok, err := conf.Exchange(r.Context(), q.Get("code"))
+	if err != nil {
+		s.logger.Warn("google code exchange failed", "err", err)
+		s.recordLogin(r, "", false)
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "could not exchange code"})
+		return
+	}
+	profile, err := fetchGoogleProfile(r.Context(), conf.Client(r.Context(), tok))
+	if err != nil {
+		s.logger.Warn("google profile fetch failed", "err", err)
+		s.recordLogin(r, "", false)
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusBadGateway, Msg: "could not fetch Google profile"})
+		return
+	}
+
+	var user User
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT id, username FROM users WHERE google_sub = ?`, profile.Sub).Scan(&user.ID, &user.Username)
+		if err == nil || !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		user.ID = genID()
+		if user.Username, err = availableUsername(tx, profile.usernameHint()); err != nil {
+			return err
+		}
+		// Google has already checked the address, so only a verified one is kept.
+		var email interface{}
+		if profile.Email != "" && profile.EmailVerified {
+			email = profile.Email
+		}
+		if _, err := tx.Exec(`INSERT INTO users(id, username, google_sub, email, email_verified) VALUES (?, ?, ?, ?, ?)`,
+			user.ID, user.Username, profile.Sub, email, email != nil); err != nil {
+			return err
+		}
+		if s.config.OnboardDeck {
+			return createOnboardingDeck(tx, user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	if s.rejectIfLocked(w, r, user.ID) {
+		return
+	}
+	s.finishSignIn(w, r, user)
+}
+
+// finishSignIn completes a first-factor sign-in: users with TOTP on get an
+// mfaToken for POST /auth/totp, everyone else their token pair.
+func (s *Server) finishSignIn(w http.ResponseWriter, r *http.Request, user User) {
+	var totpEnabled bool
+	if err := s.db.QueryRow(`SELECT totp_enabled FROM users WHERE id = ?`, user.ID).Scan(&totpEnabled); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if totpEnabled {
+		now := time.Now().UTC()
+		exp := now.Add(mfaTokenTTL)
+		mfa, err := signJWT(MFAClaims{Subject: user.ID, Purpose: "mfa", IssuedAt: now.Unix(), ExpiresAt: exp.Unix()}, s.config.AuthTokenSecret)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+			return
+		}
+		s.respondJSON(w, http.StatusOK, map[string]interface{}{
+			"mfaRequired": true,
+			"mfaToken":    mfa,
+			"expiresAt":   exp.Format(time.RFC3339),
+		})
+		return
+	}
+	s.recordLogin(r, user.ID, true)
+	s.respondTokenPair(w, r, user)
+}
+
+// respondTokenPair finishes a sign-in by issuing user's access and refresh
+// tokens.
+func (s *Server) respondTokenPair(w http.ResponseWriter, r *http.Request, user User) {
+	token, exp, err := s.issueAccessToken(user.ID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+		return
+	}
+	refresh, refreshExp, err := s.issueRefreshToken(r, user.ID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, TokenPair{
+		Token:            token,
+		ExpiresAt:        exp.Format(time.RFC3339),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: refreshExp.Format(time.RFC3339),
+		User:             user,
+	})
+}
+
+// Account lockout: lockoutFailures failed sign-ins in a row, all within
+// lockoutWindow, lock the account for lockoutDuration.
+const (
+	lockoutFailures = 5
+	lockoutWindow   = 10 * time.Minute
+	lockoutDuration = 15 * time.Minute
+)
+
+// recordLogin logs a sign-in attempt. userID is empty when the attempt
+// failed before the user was known. A failure that completes a run of
+// lockoutFailures locks the account. Errors are logged, not returned, so
+// bookkeeping never decides the outcome of a sign-in.
+func (s *Server) recordLogin(r *http.Request, userID string, success bool) {
+	now := time.Now().UTC()
+	var uid interface{}
+	if userID != "" {
+		uid = userID
+	}
+	if _, err := s.db.Exec(`INSERT INTO login_history(id, user_id, ip, success, created_at, user_agent) VALUES (?, ?, ?, ?, ?, ?)`,
+		genID(), uid, realClientIP(r, s.config.TrustedProxies), success, now.Format(time.RFC3339), r.UserAgent()); err != nil {
+		s.logger.Error("record login failed", "err", err)
+		return
+	}
+	if success || userID == "" {
+		return
+	}
+	var failures int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM (
+    SELECT success FROM login_history WHERE user_id = ? AND created_at > ?
+    ORDER BY created_at DESC, rowid DESC LIMIT ?
+) WHERE success = 0`, userID, now.Add(-lockoutWindow).Format(time.RFC3339), lockoutFailures).Scan(&failures)
+	if err != nil {
+		s.logger.Error("lockout check failed", "err", err)
+		return
+	}
+	if failures < lockoutFailures {
+		return
+	}
+	// Attempts made while locked count as failures but don't extend the lock.
+	if _, err := s.db.Exec(`UPDATE users SET locked_until = ? WHERE id = ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		now.Add(lockoutDuration).Format(time.RFC3339), userID, now.Format(time.RFC3339)); err != nil {
+		s.logger.Error("lock account failed", "err", err)
+		return
+	}
+	s.logger.Warn("account locked", "userId", userID, "until", now.Add(lockoutDuration).Format(time.RFC3339))
+}
+
+// rejectIfLocked answers with 423 and records the failed attempt when
+// userID is locked out, reporting whether it did.
+func (s *Server) rejectIfLocked(w http.ResponseWriter, r *http.Request, userID string) bool {
+	until, err := s.lockedUntil(userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return true
+	}
+	if until.IsZero() {
+		return false
+	}
+	s.recordLogin(r, userID, false)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	setError(r.Context(), AppError{Code: ErrCodeAccountLocked, Status: http.StatusLocked, Msg: "account locked after repeated failed sign-ins; try again at " + until.Format(time.RFC3339)})
+	return true
+}
+
+// lockedUntil returns when userID's lockout ends, or the zero time if the
+// account isn't locked.
+func (s *Server) lockedUntil(userID string) (time.Time, error) {
+	var v sql.NullString
+	if err := s.db.QueryRow(`SELECT locked_until FROM users WHERE id = ?`, userID).Scan(&v); err != nil {
+		return time.Time{}, err
+	}
+	if !v.Valid {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, v.String)
+	if err != nil || !until.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// LoginAttempt is one row of a user's sign-in history.
+type LoginAttempt struct {
+	ID        string `json:"id"`
+	IP        string `json:"ip,omitempty"`
+	Success   bool   `json:"success"`
+	UserAgent string `json:"userAgent,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// LoginHistoryPage is a page of sign-in attempts plus the lockout state.
+type LoginHistoryPage struct {
+	Page
+	LockedUntil *string `json:"lockedUntil"`
+}
+
+// GET /users/{userId}/login-history?limit=&offset= (admin)
+// Newest first, with lockedUntil set while the account is locked.
+func (s *Server) loginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	until, err := s.lockedUntil(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM login_history WHERE user_id = ?`, userID).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT id, COALESCE(ip, ''), success, COALESCE(user_agent, ''), created_at FROM login_history
+WHERE user_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	items := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.IP, &a.Success, &a.UserAgent, &a.CreatedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		items = append(items, a)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	out := LoginHistoryPage{Page: Page{Items: items, Total: total, Limit: limit, Offset: offset}}
+	if !until.IsZero() {
+		v := until.Format(time.RFC3339)
+		out.LockedUntil = &v
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// googleProfile is the subset of Google's userinfo response we use.
+type googleProfile struct {
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// usernameHint is the preferred username for a new Google user: the local
+// part of their email, else their name.
+func (p googleProfile) usernameHint() string {
+	if local, _, ok := strings.Cut(p.Email, "@"); ok && local != "" {
+		return local
+	}
+	if name := strings.TrimSpace(p.Name); name != "" {
+		return name
+	}
+	return "user"
+}
+
+func fetchGoogleProfile(ctx context.Context, client *http.Client) (googleProfile, error) {
+	var p googleProfile
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, googleUserInfoURL, nil)
+	if err != nil {
+		return p, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("userinfo: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return p, err
+	}
+	if p.Sub == "" {
+		return p, errors.New("userinfo: missing sub")
+	}
+	return p, nil
+}
+
+// availableUsername returns base, or base followed by the lowest number
+// that makes it unique.
+func availableUsername(tx *sql.Tx, base string) (string, error) {
+	name := base
+	for n := 2; ; n++ {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, name).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+		name = base + strconv.Itoa(n)
+	}
+}
+
+/* ---------- Handlers: Two-factor authentication ---------- */
+
+// totpIssuer labels the account in authenticator apps.
+const totpIssuer = "Flashcards"
+
+// Backup codes are single-use stand-ins for a TOTP code.
+const (
+	backupCodeCount  = 10
+	backupCodeLength = 10
+)
+
+// mfaTokenTTL is how long a user has to enter their second factor after
+// signing in with Google.
+const mfaTokenTTL = 5 * time.Minute
+
+// MFAClaims is the payload of the token handed out between the first and
+// second factor. Purpose keeps it from being mistaken for an access token.
+type MFAClaims struct {
+	Subject   string `json:"sub"` // user ID
+	Purpose   string `json:"purpose"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// POST /users/{userId}/totp/setup (bearer access token of userId)
+// Generates a new TOTP secret and backup codes, replacing any from an
+// unfinished setup. TOTP stays off until a code is confirmed through
+// POST /users/{userId}/totp/verify. otpauthUrl is what goes in the QR code.
+func (s *Server) totpSetupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	if !s.requireSelf(r, userID) {
+		return
+	}
+	var username string
+	var enabled bool
+	if err := s.db.QueryRow(`SELECT username, totp_enabled FROM users WHERE id = ?`, userID).Scan(&username, &enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if enabled {
+		setError(r.Context(), AppError{Code: ErrCodeTOTPEnabled, Status: http.StatusConflict, Msg: "TOTP is already enabled"})
+		return
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: username})
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate secret"})
+		return
+	}
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		if codes[i], err = randomBase58(backupCodeLength); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate backup codes"})
+			return
+		}
+	}
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, key.Secret(), userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM totp_backup_codes WHERE user_id = ?`, userID); err != nil {
+			return err
+		}
+		for _, c := range codes {
+			if _, err := tx.Exec(`INSERT INTO totp_backup_codes(user_id, code_hash) VALUES (?, ?)`, userID, hashToken(c)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"secret":      key.Secret(),
+		"otpauthUrl":  key.URL(),
+		"backupCodes": codes,
+	})
+}
+
+// POST /users/{userId}/totp/verify (bearer access token of userId)
+// body: { "code": "123456" }
+// Checks a code from the authenticator app. The first valid code after
+// setup turns TOTP on.
+func (s *Server) totpVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	if !s.requireSelf(r, userID) {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Code) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "code required"})
+		return
+	}
+	var secret sql.NullString
+	if err := s.db.QueryRow(`SELECT totp_secret FROM users WHERE id = ?`, userID).Scan(&secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if !secret.Valid {
+		setError(r.Context(), AppError{Code: ErrCodeTOTPNotSetUp, Status: http.StatusConflict, Msg: "TOTP has not been set up"})
+		return
+	}
+	if !totp.Validate(strings.TrimSpace(req.Code), secret.String) {
+		setError(r.Context(), AppError{Code: ErrCodeTOTPInvalid, Status: http.StatusUnauthorized, Msg: "invalid TOTP code"})
+		return
+	}
+	if _, err := s.db.Exec(`UPDATE users SET totp_enabled = 1 WHERE id = ?`, userID); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]bool{"enabled": true})
+}
+
+// POST /auth/totp
+// body: { "mfaToken": "...", "code": "123456" }
+// The second step of signing in when TOTP is on. code is either a current
+// TOTP code or an unused backup code, which is then spent. Wrong codes
+// count towards the account lockout.
+func (s *Server) totpLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfaToken"`
+		Code     string `json:"code"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	code := strings.TrimSpace(req.Code)
+	if req.MFAToken == "" || code == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "mfaToken and code required"})
+		return
+	}
+	var claims MFAClaims
+	if err := verifyJWT(req.MFAToken, s.config.AuthTokenSecret, &claims); err != nil || claims.Purpose != "mfa" {
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid or expired mfaToken"})
+		return
+	}
+	var user User
+	var secret sql.NullString
+	if err := s.db.QueryRow(`SELECT id, username, totp_secret FROM users WHERE id = ?`, claims.Subject).Scan(&user.ID, &user.Username, &secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid or expired mfaToken"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if s.rejectIfLocked(w, r, user.ID) {
+		return
+	}
+	ok := secret.Valid && totp.Validate(code, secret.String)
+	if !ok {
+		res, err := s.db.Exec(`DELETE FROM totp_backup_codes WHERE user_id = ? AND code_hash = ?`, user.ID, hashToken(code))
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		n, _ := res.RowsAffected()
+		ok = n == 1
+	}
+	if !ok {
+		s.recordLogin(r, user.ID, false)
+		setError(r.Context(), AppError{Code: ErrCodeTOTPInvalid, Status: http.StatusUnauthorized, Msg: "invalid TOTP code"})
+		return
+	}
+	s.recordLogin(r, user.ID, true)
+	s.respondTokenPair(w, r, user)
+}
+
+/* ---------- Email ---------- */
+
+// Emailer delivers plain-text email.
+type Emailer interface {
+	Send(to, subject, body string) error
+}
+
+// newEmailer returns an SMTP emailer when SMTP_ADDR is set and a logging
+// stub otherwise.
+func newEmailer(cfg Config, logger *slog.Logger) Emailer {
+	if cfg.SMTPAddr == "" {
+		return logEmailer{logger: logger}
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return smtpEmailer{addr: cfg.SMTPAddr, from: cfg.SMTPFrom, auth: auth}
+}
+
+// logEmailer writes messages to the log instead of sending them, for
+// development and deployments without a mail server.
+type logEmailer struct {
+	logger *slog.Logger
+}
+
+func (e logEmailer) Send(to, subject, body string) error {
+	e.logger.Info("email", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+// smtpEmailer sends messages through an SMTP relay.
+type smtpEmailer struct {
+	addr string
+	from string
+	auth smtp.Auth // nil for relays that don't require login
+}
+
+func (e smtpEmailer) Send(to, subject, body string) error {
+	msg := "From: " + e.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(e.addr, e.auth, e.from, []string{to}, []byte(msg))
+}
+
+/* ---------- Handlers: Email verification ---------- */
+
+// emailVerificationTTL is how long a verification link stays valid.
+const emailVerificationTTL = 48 * time.Hour
+
+// newEmailVerification replaces userID's pending verification with a new
+// token (32 random bytes, hex-encoded) and returns it. Only its hash is
+// stored.
+func newEmailVerification(tx *sql.Tx, userID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	_, err := tx.Exec(`INSERT INTO email_verifications(user_id, token_hash, expires_at) VALUES (?, ?, ?)
+ON CONFLICT(user_id) DO UPDATE SET token_hash = excluded.token_hash, expires_at = excluded.expires_at`,
+		userID, hashToken(token), time.Now().UTC().Add(emailVerificationTTL).Format(time.RFC3339))
+	return token, err
+}
+
+// sendVerificationEmail mails the verification link. A failed send is
+// logged rather than failing the request; the user can ask for a new link.
+// The link is built from Config.PublicBaseURL only, so a forged Host header
+// can't point it elsewhere.
+func (s *Server) sendVerificationEmail(email, token string) {
+	if s.config.PublicBaseURL == "" {
+		s.logger.Error("PUBLIC_BASE_URL not set; not sending verification email", "to", email)
+		return
+	}
+	link := s.config.PublicBaseURL + "/verify-email?token=" + token
+	body := "Confirm your email address by opening this link:\n\n" + link +
+		"\n\nThe link expires in 48 hours.\n"
+	if err := s.mailer.Send(email, "Verify your email address", body); err != nil {
+		s.logger.Error("send verification email", "to", email, "err", err)
+	}
+}
+
+// rejectIfUnverified answers with 403 unless userID has a verified email
+// address, reporting whether it did. Users without an email address are
+// unverified too; otherwise signing up without one would skip the check.
+func (s *Server) rejectIfUnverified(r *http.Request, userID string) bool {
+	var verified bool
+	err := s.db.QueryRow(`SELECT email IS NOT NULL AND email_verified FROM users WHERE id = ?`, userID).Scan(&verified)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return true
+	}
+	if !verified {
+		setError(r.Context(), AppError{Code: ErrCodeEmailUnverified, Status: http.StatusForbidden, Msg: "verify your email address before making decks public"})
+		return true
+	}
+	return false
+}
+
+// GET /verify-email?token=
+// The link sent by email. Marks the address verified and spends the token.
+func (s *Server) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "token required"})
+		return
+	}
+	var userID string
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT user_id FROM email_verifications WHERE token_hash = ? AND expires_at > ?`,
+			hashToken(token), time.Now().UTC().Format(time.RFC3339)).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid or expired verification token"}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET email_verified = 1 WHERE id = ?`, userID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{"userId": userID, "emailVerified": true})
+}
+
+// POST /users/{userId}/resend-verification
+// Sends a fresh verification link; earlier links stop working.
+func (s *Server) resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var email sql.NullString
+	var verified bool
+	if err := s.db.QueryRow(`SELECT email, email_verified FROM users WHERE id = ?`, userID).Scan(&email, &verified); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if !email.Valid {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "user has no email address"})
+		return
+	}
+	if verified {
+		setError(r.Context(), AppError{Code: ErrCodeEmailVerified, Status: http.StatusConflict, Msg: "email address already verified"})
+		return
+	}
+	var token string
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		token, err = newEmailVerification(tx, userID)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.sendVerificationEmail(email.String, token)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/* ---------- Handlers: Passwords ---------- */
+
+// Passwords are stored as PBKDF2-SHA256; see hashPassword for the format.
+const (
+	passwordIterations = 600000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+	minPasswordLen     = 8
+	passwordResetTTL   = time.Hour
+)
+
+// hashPassword encodes password as "pbkdf2-sha256$<iterations>$<salt>$<key>",
+// salt and key in unpadded base64.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// POST /auth/login
+// body: { "username": "...", "password": "..." }
+// Password sign-in for accounts that have set one through the reset flow.
+// Like Google sign-in it answers a TokenPair, or an mfaToken when TOTP is on,
+// and failures count towards the account lockout.
+func (s *Server) passwordLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "username and password required"})
+		return
+	}
+	var user User
+	var hash sql.NullString
+	err := s.db.QueryRow(`SELECT id, username, password_hash FROM users WHERE username = ?`, req.Username).Scan(&user.ID, &user.Username, &hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if user.ID != "" && s.rejectIfLocked(w, r, user.ID) {
+		return
+	}
+	if !hash.Valid || !checkPassword(hash.String, req.Password) {
+		s.recordLogin(r, user.ID, false)
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid username or password"})
+		return
+	}
+	s.finishSignIn(w, r, user)
+}
+
+// POST /auth/forgot-password
+// body: { "email": "..." }
+// Mails a one-hour reset link to every account with this verified address.
+// The answer is 202 whether or not any account matched, so the endpoint
+// doesn't reveal which addresses are registered. The link points at
+// Config.PasswordResetURL; while that is unset nothing is sent.
+func (s *Server) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Email) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "email required"})
+		return
+	}
+	if s.config.PasswordResetURL == "" {
+		s.logger.Error("PASSWORD_RESET_URL not set; not sending password reset email", "to", req.Email)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	type reset struct{ username, token string }
+	var resets []reset
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, username FROM users WHERE email = ? AND email_verified`, req.Email)
+		if err != nil {
+			return err
+		}
+		var users [][2]string
+		for rows.Next() {
+			var id, username string
+			if err := rows.Scan(&id, &username); err != nil {
+				rows.Close()
+				return err
+			}
+			users = append(users, [2]string{id, username})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		expires := time.Now().UTC().Add(passwordResetTTL).Format(time.RFC3339)
+		for _, u := range users {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			token := hex.EncodeToString(b)
+			if _, err := tx.Exec(`INSERT INTO password_resets(token_hash, user_id, expires_at) VALUES (?, ?, ?)`, hashToken(token), u[0], expires); err != nil {
+				return err
+			}
+			resets = append(resets, reset{username: u[1], token: token})
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	for _, rs := range resets {
+		link := s.config.PasswordResetURL + "?token=" + rs.token
+		body := "Someone asked to reset the password of the flashcards account " + rs.username +
+			". To choose a new password, open this link:\n\n" + link +
+			"\n\nThe link expires in one hour. If you didn't ask for this, ignore this email.\n"
+		if err := s.mailer.Send(req.Email, "Reset your password", body); err != nil {
+			s.logger.Error("send password reset email", "to", req.Email, "err", err)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// POST /auth/reset-password
+// body: { "token": "...", "newPassword": "..." }
+// Sets the password of the account the reset link was sent for and spends
+// the token. Every device is signed out, as the old password may have
+// leaked. Unknown, expired and used tokens get 400 reset_token_invalid.
+func (s *Server) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.Token == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "token required"})
+		return
+	}
+	if len([]rune(req.NewPassword)) < minPasswordLen {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("newPassword must be at least %d characters", minPasswordLen)})
+		return
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not hash password"})
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var userID string
+		err := tx.QueryRow(`SELECT user_id FROM password_resets WHERE token_hash = ? AND expires_at > ? AND used_at IS NULL`,
+			hashToken(req.Token), now).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return AppError{Code: ErrCodeResetTokenInvalid, Status: http.StatusBadRequest, Msg: "invalid, expired or used reset token"}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE token_hash = ?`, now, hashToken(req.Token)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, hash, userID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------- Handlers: Preferences ---------- */
+
+// Preferences are per-user study settings. NewCardsPerDay and ReviewLimit
+// are daily caps applied by GET /study/next and GET /decks/{deckId}/overdue.
+type Preferences struct {
+	NewCardsPerDay    int    `json:"newCardsPerDay"`
+	ReviewLimit       int    `json:"reviewLimit"`
+	HintDelaySeconds  int    `json:"hintDelaySeconds"`
+	InterfaceLanguage string `json:"interfaceLanguage,omitempty"`
+}
+
+// defaultPreferences apply to users who haven't saved any.
+var defaultPreferences = Preferences{NewCardsPerDay: 20, ReviewLimit: 100, HintDelaySeconds: 10}
+
+// Upper bounds for the numeric preferences.
+const (
+	maxHintDelaySeconds = 600
+	maxNewCardsPerDay   = 1000
+	maxReviewLimit      = 10000
+)
+
+// fetchPreferences returns userID's preferences, or the defaults when none
+// are stored.
+func fetchPreferences(q queryRower, userID string) (Preferences, error) {
+	var p Preferences
+	err := q.QueryRow(`SELECT new_cards_per_day, review_limit, hint_delay_seconds, COALESCE(interface_language, '')
+FROM user_preferences WHERE user_id = ?`, userID).Scan(&p.NewCardsPerDay, &p.ReviewLimit, &p.HintDelaySeconds, &p.InterfaceLanguage)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultPreferences, nil
+	}
+	return p, err
+}
+
+// studiedToday counts the user's reviews since the start of today in loc,
+// split into reviews of cards seen before and first reviews of new cards.
+// A card's first review is the one that starts from interval 0.
+func (s *Server) studiedToday(userID string, loc *time.Location) (reviews, newCards int, err error) {
+	y, m, d := time.Now().In(loc).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc).UTC().Format(time.RFC3339)
+	err = s.db.QueryRow(`SELECT COALESCE(SUM(interval_before > 0), 0), COALESCE(SUM(interval_before = 0), 0)
+FROM review_log WHERE user_id = ? AND reviewed_at >= ?`, userID, start).Scan(&reviews, &newCards)
+	return reviews, newCards, err
+}
+
+// GET /users/{userId}/preferences
+func (s *Server) getPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	prefs, err := fetchPreferences(s.db, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, prefs)
+}
+
+// PATCH /users/{userId}/preferences (also POST)
+// body: { newCardsPerDay, reviewLimit, hintDelaySeconds, interfaceLanguage }
+// Omitted settings keep their current value; an empty interfaceLanguage
+// clears it. Responds with all preferences.
+func (s *Server) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var req struct {
+		NewCardsPerDay    *int    `json:"newCardsPerDay"`
+		ReviewLimit       *int    `json:"reviewLimit"`
+		HintDelaySeconds  *int    `json:"hintDelaySeconds"`
+		InterfaceLanguage *string `json:"interfaceLanguage"`
+	}
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, errEmptyBody) {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	updates := map[string]interface{}{}
+	for _, f := range []struct {
+		name, column string
+		value        *int
+		max          int
+	}{
+		{"newCardsPerDay", "new_cards_per_day", req.NewCardsPerDay, maxNewCardsPerDay},
+		{"reviewLimit", "review_limit", req.ReviewLimit, maxReviewLimit},
+		{"hintDelaySeconds", "hint_delay_seconds", req.HintDelaySeconds, maxHintDelaySeconds},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < 0 || *f.value > f.max {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("%s must be between 0 and %d", f.name, f.max)})
+			return
+		}
+		updates[f.column] = *f.value
+	}
+	if req.InterfaceLanguage != nil {
+		updates["interface_language"] = nil
+		if *req.InterfaceLanguage != "" {
+			if !langCodePattern.MatchString(*req.InterfaceLanguage) {
+				setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "interfaceLanguage must be a language code like en or pt-BR"})
+				return
+			}
+			updates["interface_language"] = *req.InterfaceLanguage
+		}
+	}
+	var prefs Preferences
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var tmp string
+		if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"}
+			}
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO user_preferences(user_id) VALUES (?)`, userID); err != nil {
+			return err
+		}
+		if len(updates) > 0 {
+			setParts := []string{}
+			args := []interface{}{}
+			for k, v := range updates {
+				setParts = append(setParts, fmt.Sprintf("%s = ?", k))
+				args = append(args, v)
+			}
+			args = append(args, userID)
+			if _, err := tx.Exec(`UPDATE user_preferences SET `+strings.Join(setParts, ", ")+` WHERE user_id = ?`, args...); err != nil {
+				return err
+			}
+		}
+		var err error
+		prefs, err = fetchPreferences(tx, userID)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, prefs)
+}
+
+/* ---------- Handlers: Sessions ---------- */
+
+// Session is a device signed in to a user's account.
+type Session struct {
+	ID         string `json:"id"`
+	DeviceName string `json:"deviceName"`
+	IPAddress  string `json:"ipAddress,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt"`
+}
+
+// deviceName summarises a User-Agent as "Browser on OS". It only tells
+// the common cases apart; anything else is "Unknown browser" or the like.
+func deviceName(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		platform = "macOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+	return browser + " on " + platform
+}
+
+// GET /users/{userId}/sessions (user's access token or admin token)
+// Devices with an unexpired refresh token, most recently used first.
+func (s *Server) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	if !s.requireSelfOrAdmin(r, userID) {
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT us.id, us.device_name, COALESCE(us.ip_address, ''), us.created_at, us.last_used_at
+FROM user_sessions us
+JOIN refresh_tokens rt ON rt.token_hash = us.refresh_token_hash
+WHERE us.user_id = ? AND rt.expires_at > ?
+ORDER BY us.last_used_at DESC, us.created_at DESC`, userID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.DeviceName, &sess.IPAddress, &sess.CreatedAt, &sess.LastUsedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, sess)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// DELETE /users/{userId}/sessions/{sessionId} (user's access token or admin token)
+// Signs one device out by revoking its refresh token; the session row goes
+// with it.
+func (s *Server) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID := chi.URLParam(r, "userId"), chi.URLParam(r, "sessionId")
+	if !s.requireSelfOrAdmin(r, userID) {
+		return
+	}
+	res, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE token_hash =
+    (SELECT refresh_token_hash FROM user_sessions WHERE id = ? AND user_id = ?)`, sessionID, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeNotFound, Status: http.StatusNotFound, Msg: "session not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /users/{userId}/sessions (user's access token or admin token)
+// Signs every device out.
+func (s *Server) revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	if !s.requireSelfOrAdmin(r, userID) {
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------- Handlers: Users ---------- */
+
+// POST /users
+// body: { "username": "...", "email": "..." }
+// email is optional; when given, a verification link is sent to it.
+func (s *Server) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if err := validateUsername(req.Username); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	var email interface{}
+	if req.Email != "" {
+		if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid email address"})
+			return
+		}
+		email = req.Email
+	}
+	id := genID()
+	var token string
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO users(id, username, email) VALUES (?, ?, ?)`, id, req.Username, email); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				return AppError{Code: ErrCodeUsernameTaken, Status: http.StatusConflict, Msg: "username already exists"}
+			}
+			return err
+		}
+		if req.Email != "" {
+			var err error
+			if token, err = newEmailVerification(tx, id); err != nil {
+				return err
+			}
+		}
+		if s.config.OnboardDeck {
+			return createOnboardingDeck(tx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	user := User{ID: id, Username: req.Username}
+	if req.Email != "" {
+		s.sendVerificationEmail(req.Email, token)
+		verified := false
+		user.Email, user.EmailVerified = req.Email, &verified
+	}
+	s.respondJSON(w, http.StatusCreated, user)
+}
+
+// onboardingJSON is the "Getting Started" deck new users get with
+// ONBOARD_DECK=true. Edit onboarding.json to change it.
+//
+//go:embed onboarding.json
+var onboardingJSON []byte
+
+type deckSeed struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Cards       []CardRequest `json:"cards"`
+}
+
+// onboardingDeck is parsed once at startup so a broken template fails fast.
+var onboardingDeck = func() deckSeed {
+	var d deckSeed
+	if err := json.Unmarshal(onboardingJSON, &d); err != nil {
+		panic("onboarding.json: " + err.Error())
+	}
+	return d
+}()
+
+// createOnboardingDeck gives userID their own copy of the onboarding deck.
+func createOnboardingDeck(tx *sql.Tx, userID string) error {
+	deckID := genID()
+	if err := insertWithSlug(onboardingDeck.Name, deckID, func(slug string) error {
+		_, err := tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug) VALUES (?, ?, ?, ?, ?)`,
+			deckID, onboardingDeck.Name, onboardingDeck.Description, userID, slug)
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, c := range onboardingDeck.Cards {
+		if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, genID(), deckID, c.Front, c.Back); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET /users?username= (partial match)
+func (s *Server) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("username")
+	var rows *sql.Rows
+	var err error
+	if q == "" {
+		rows, err = s.db.Query(`SELECT id, username FROM users`)
+	} else {
+		rows, err = s.db.Query(`SELECT id, username FROM users WHERE username LIKE ?`, "%"+q+"%")
+	}
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, u)
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// validateUsername applies the rules POST /users enforces on a new username.
+func validateUsername(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("username required")
+	}
+	return nil
+}
+
+// maxUsernameChecks caps how many names one POST /users/available may ask about.
+const maxUsernameChecks = 100
+
+// GET /users/available?username=
+// Reports whether POST /users would accept the name right now.
+func (s *Server) usernameAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("username")
+	if err := validateUsername(name); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	taken, err := s.takenUsernames([]string{name})
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]bool{"available": !taken[name]})
+}
+
+// POST /users/available
+// body: { "usernames": ["alice", "bob"] }
+// Answers { "available": { "alice": false, "bob": true } }; names that fail
+// validation are reported unavailable.
+func (s *Server) usernamesAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Usernames []string `json:"usernames"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len(req.Usernames) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "usernames required"})
+		return
+	}
+	if len(req.Usernames) > maxUsernameChecks {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("at most %d usernames per request", maxUsernameChecks)})
+		return
+	}
+	var valid []string
+	for _, name := range req.Usernames {
+		if validateUsername(name) == nil {
+			valid = append(valid, name)
+		}
+	}
+	taken, err := s.takenUsernames(valid)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	out := make(map[string]bool, len(req.Usernames))
+	for _, name := range req.Usernames {
+		out[name] = validateUsername(name) == nil && !taken[name]
+	}
+	s.respondJSON(w, http.StatusOK, map[string]map[string]bool{"available": out})
+}
+
+// takenUsernames returns which of names already belong to a user.
+func (s *Server) takenUsernames(names []string) (map[string]bool, error) {
+	taken := map[string]bool{}
+	if len(names) == 0 {
+		return taken, nil
+	}
+	args := make([]interface{}, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := s.db.Query(`SELECT username FROM users WHERE username IN (`+placeholders(len(names))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		taken[name] = true
+	}
+	return taken, rows.Err()
+}
+
+// GET /users/{userId}
+func (s *Server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "userId")
+	var u User
+	var email sql.NullString
+	var verified bool
+	err := s.db.QueryRow(`SELECT id, username, COALESCE(timezone, ''), email, email_verified FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.Username, &u.Timezone, &email, &verified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if email.Valid {
+		u.Email, u.EmailVerified = email.String, &verified
+	}
+	s.respondJSON(w, http.StatusOK, u)
+}
+
+// PATCH /users/{userId}
+// body: { "username": "...", "timezone": "Europe/Berlin" }
+// A username can only be changed once per Config.UsernameChangeCooldown.
+// timezone must be an IANA zone name; an empty string resets it to UTC.
+func (s *Server) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "userId")
+	var patch struct {
+		Username *string `json:"username"`
+		Timezone *string `json:"timezone"`
+	}
+	if err := decodeJSON(r, &patch); err != nil && !errors.Is(err, errEmptyBody) {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if patch.Username == nil && patch.Timezone == nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	if patch.Username != nil && strings.TrimSpace(*patch.Username) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "username cannot be empty"})
+		return
+	}
+	if patch.Timezone != nil && *patch.Timezone != "" {
+		if _, err := time.LoadLocation(*patch.Timezone); err != nil || *patch.Timezone == "Local" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("unknown timezone %q", *patch.Timezone)})
+			return
+		}
+	}
+
+	var u User
+	var changedAt sql.NullString
+	err := s.db.QueryRow(`SELECT id, username, username_changed_at, COALESCE(timezone, '') FROM users WHERE id = ?`, id).Scan(&u.ID, &u.Username, &changedAt, &u.Timezone)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	setTimezone := patch.Timezone != nil && *patch.Timezone != u.Timezone
+	rename := patch.Username != nil && *patch.Username != u.Username
+	// The cooldown is checked before anything is written, so a rejected
+	// rename leaves the timezone alone too.
+	now := time.Now().UTC()
+	if rename && changedAt.Valid {
+		if last, err := time.Parse(time.RFC3339, changedAt.String); err == nil {
+			if availableAt := last.Add(s.config.UsernameChangeCooldown); now.Before(availableAt) {
+				at := availableAt.Format(time.RFC3339)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(availableAt.Sub(now).Seconds()))))
+				setError(r.Context(), AppError{Code: ErrCodeUsernameCooldown, Status: http.StatusTooManyRequests,
+					Msg: "username was changed recently; it can be changed again at " + at, Details: map[string]interface{}{"availableAt": at}})
+				return
+			}
+		}
+	}
+
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if setTimezone {
+			tz := sql.NullString{String: *patch.Timezone, Valid: *patch.Timezone != ""}
+			if _, err := tx.Exec(`UPDATE users SET timezone = ? WHERE id = ?`, tz, id); err != nil {
+				return err
+			}
+		}
+		if rename {
+			_, err := tx.Exec(`UPDATE users SET username = ?, username_changed_at = ? WHERE id = ?`, *patch.Username, now.Format(time.RFC3339), id)
+			if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+				return AppError{Code: ErrCodeUsernameTaken, Status: http.StatusConflict, Msg: "username already exists"}
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	if setTimezone {
+		u.Timezone = *patch.Timezone
+	}
+	if rename {
+		u.Username = *patch.Username
+	}
+	s.respondJSON(w, http.StatusOK, u)
+}
+
+/* ---------- Handlers: Decks ---------- */
+
+// POST /decks
+// body: { name, description, userId, cards?: [{front,back}, ...] }
+func (s *Server) createDeckHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string        `json:"name"`
+		Description   string        `json:"description"`
+		UserID        string        `json:"userId"`
+		IsPublic      bool          `json:"isPublic"`
+		CaseSensitive bool          `json:"caseSensitive"`
+		ParentID      string        `json:"parentId"`
+		Cards         []CardRequest `json:"cards"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.UserID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "name and userId required"})
+		return
+	}
+	// Ensure user exists
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	if req.IsPublic && s.rejectIfUnverified(r, req.UserID) {
+		return
+	}
+	deckID := genID()
+	var parentID interface{}
+	if req.ParentID != "" {
+		parentID = req.ParentID
+	}
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if req.ParentID != "" {
+			if err := checkDeckParent(tx, deckID, req.UserID, req.ParentID); err != nil {
+				return err
+			}
+		}
+		// Concurrent creates with the same name race on idx_decks_user_name;
+		// the loser's insert does nothing and is reported as a conflict. Only
+		// that conflict is swallowed: any other constraint still fails.
+		var res sql.Result
+		err := insertWithSlug(req.Name, deckID, func(slug string) (err error) {
+			res, err = tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug, is_public, case_sensitive, parent_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(user_id, name) DO NOTHING`,
+				deckID, req.Name, req.Description, req.UserID, slug, req.IsPublic, req.CaseSensitive, parentID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return AppError{Code: ErrCodeDeckNameTaken, Status: http.StatusConflict, Msg: "user already has a deck with this name"}
+		}
+		// insert cards if any
+		for i, c := range req.Cards {
+			if strings.TrimSpace(c.Front) == "" || strings.TrimSpace(c.Back) == "" {
+				return AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("cards[%d]: front/back required", i)}
+			}
+			cardID := genID()
+			if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, cardID, deckID, c.Front, c.Back); err != nil {
+				return err
+			}
+			if _, err := tagCard(tx, cardID, c.Tags); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+
+	s.recordAudit(deckID, req.UserID, "deck.create", map[string]interface{}{"name": req.Name, "cards": len(req.Cards)})
+
+	deck, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, deck)
+}
+
+type CardRequest struct {
+	Front string   `json:"front"`
+	Back  string   `json:"back"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// DeckOverview is a deck without its cards, as listed on a user's home screen.
+type DeckOverview struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Slug        string  `json:"slug,omitempty"`
+	IsPublic    bool    `json:"isPublic"`
+	Archived    bool    `json:"archived"`
+	CardCount   int     `json:"cardCount"`
+	NextDueAt   *string `json:"nextDueAt"`
+}
+
+// deckOrderings maps ?orderBy= values of GET /users/{userId}/decks to SQL.
+var deckOrderings = map[string]string{
+	"name":    "d.name, d.rowid",
+	"nextDue": "next_due IS NULL, next_due, d.name",
+}
+
+// GET /users/{userId}/decks?orderBy=name|nextDue
+// The user's own decks. nextDueAt is the earliest due date among cards the
+// user has reviewed; decks without one sort last under orderBy=nextDue.
+func (s *Server) listUserDecksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	orderBy := r.URL.Query().Get("orderBy")
+	if orderBy == "" {
+		orderBy = "name"
+	}
+	order, ok := deckOrderings[orderBy]
+	if !ok {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "orderBy must be name or nextDue"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.id, d.name, COALESCE(d.description, ''), COALESCE(d.slug, ''), d.is_public, d.archived,
+    (SELECT COUNT(*) FROM cards c WHERE c.deck_id = d.id),
+    (SELECT MIN(cs.due_at) FROM card_schedules cs JOIN cards c ON c.id = cs.card_id
+     WHERE c.deck_id = d.id AND cs.user_id = d.user_id) AS next_due
+FROM decks d WHERE d.user_id = ?
+ORDER BY `+order, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []DeckOverview{}
+	for rows.Next() {
+		var d DeckOverview
+		var next sql.NullString
+		if err := rows.Scan(&d.ID, &d.Name, &d.Description, &d.Slug, &d.IsPublic, &d.Archived, &d.CardCount, &next); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if next.Valid {
+			d.NextDueAt = &next.String
+		}
+		out = append(out, d)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// DeckSize is a deck and how many cards it holds.
+type DeckSize struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Slug      string `json:"slug,omitempty"`
+	CardCount int    `json:"cardCount"`
+}
+
+// GET /users/{userId}/decks/largest?limit=
+// The user's decks by card count, largest first, counted in one grouped
+// query. Cards are hard-deleted, so every remaining row counts.
+func (s *Server) largestUserDecksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, 100)
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.id, d.name, COALESCE(d.slug, ''), COUNT(c.id) AS card_count
+FROM decks d
+LEFT JOIN cards c ON c.deck_id = d.id
+WHERE d.user_id = ?
+GROUP BY d.id
+ORDER BY card_count DESC, d.name, d.rowid
+LIMIT ?`, userID, limit)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []DeckSize{}
+	for rows.Next() {
+		var d DeckSize
+		if err := rows.Scan(&d.ID, &d.Name, &d.Slug, &d.CardCount); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, d)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// DeckTreeNode is a deck with its child decks, for a folder-style sidebar.
+type DeckTreeNode struct {
+	Deck     DeckSize       `json:"deck"`
+	Children []DeckTreeNode `json:"children"`
+}
+
+// GET /users/{userId}/decks/tree
+// The user's decks nested by parentId, siblings by name. Decks whose parent
+// is gone or belongs to someone else are top-level.
+func (s *Server) deckTreeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.id, d.name, COALESCE(d.slug, ''), COALESCE(d.parent_id, ''), COUNT(c.id)
+FROM decks d
+LEFT JOIN cards c ON c.deck_id = d.id
+WHERE d.user_id = ?
+GROUP BY d.id
+ORDER BY d.name, d.rowid`, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	var decks []DeckSize
+	parents := map[string]string{}
+	for rows.Next() {
+		var d DeckSize
+		var parentID string
+		if err := rows.Scan(&d.ID, &d.Name, &d.Slug, &parentID, &d.CardCount); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		decks = append(decks, d)
+		parents[d.ID] = parentID
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, buildDeckTree(decks, parents))
+}
+
+// buildDeckTree nests decks under their parents, keeping the input order
+// among siblings. Each deck appears exactly once: a parent cycle can't be
+// created through the API, but should one exist, its decks are surfaced at
+// the top level with the edge back into the cycle dropped.
+func buildDeckTree(decks []DeckSize, parents map[string]string) []DeckTreeNode {
+	index := make(map[string]int, len(decks))
+	for i, d := range decks {
+		index[d.ID] = i
+	}
+	children := map[string][]string{}
+	var roots []string
+	for _, d := range decks {
+		if _, ok := index[parents[d.ID]]; ok {
+			children[parents[d.ID]] = append(children[parents[d.ID]], d.ID)
+		} else {
+			roots = append(roots, d.ID)
+		}
+	}
+	visited := map[string]bool{}
+	var build func(id string) DeckTreeNode
+	build = func(id string) DeckTreeNode {
+		visited[id] = true
+		n := DeckTreeNode{Deck: decks[index[id]], Children: []DeckTreeNode{}}
+		for _, c := range children[id] {
+			if !visited[c] {
+				n.Children = append(n.Children, build(c))
+			}
+		}
+		return n
+	}
+	out := []DeckTreeNode{}
+	for _, id := range roots {
+		out = append(out, build(id))
+	}
+	for _, d := range decks {
+		if !visited[d.ID] {
+			out = append(out, build(d.ID))
+		}
+	}
+	return out
+}
+
+// GET /decks?name=  (partial match)
+func (s *Server) listDecksHandler(w http.ResponseWriter, r *http.Request) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if q := r.URL.Query().Get("name"); q != "" {
+		where = append(where, "name LIKE ?")
+		args = append(args, "%"+q+"%")
+	}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		where = append(where, "id IN (SELECT dt.deck_id FROM deck_tags dt JOIN tags t ON t.id = dt.tag_id WHERE t.name = ?)")
+		args = append(args, normalizeTag(tag))
+	}
+	rows, err := s.db.Query(`SELECT id FROM decks WHERE `+strings.Join(where, " AND "), args...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	decks := make([]Deck, 0, len(ids))
+	for start := 0; start < len(ids); start += listDecksBatch {
+		chunk := ids[start:min(start+listDecksBatch, len(ids))]
+		byID, err := s.fetchDecksByIDs(chunk)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		for _, id := range chunk {
+			if d, ok := byID[id]; ok {
+				decks = append(decks, d)
+			}
+		}
+	}
+	s.respondJSON(w, http.StatusOK, decks)
+}
+
+// listDecksBatch is how many decks GET /decks loads per fetchDecksByIDs
+// call, keeping its IN lists well under SQLite's bound parameter limit.
+const listDecksBatch = 500
+
+// GET /decks/{deckId}
+func (s *Server) getDeckHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	d, err := s.fetchDeckByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, d)
+}
+
+// maxBatchGetDecks caps the IDs accepted by POST /decks/batch.
+const maxBatchGetDecks = 50
+
+// POST /decks/batch
+// body: { deckIds }
+// The decks keyed by ID, for cache hydration. Unknown IDs are left out of
+// the map rather than failing the request.
+func (s *Server) batchGetDecksHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DeckIDs []string `json:"deckIds"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len(req.DeckIDs) > maxBatchGetDecks {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("at most %d deckIds per request", maxBatchGetDecks)})
+		return
+	}
+	decks, err := s.fetchDecksByIDs(req.DeckIDs)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{"decks": decks})
+}
+
+// GET /decks/by-slug/{slug}
+func (s *Server) getDeckBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+	var id string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE slug = ?`, slug).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	d, err := s.fetchDeckByID(id)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, d)
+}
+
+func (s *Server) fetchDeckByID(id string) (Deck, error) {
+	decks, err := s.fetchDecksByIDs([]string{id})
+	if err != nil {
+		return Deck{}, err
+	}
+	d, ok := decks[id]
+	if !ok {
+		return Deck{}, sql.ErrNoRows
+	}
+	return d, nil
+}
+
+// fetchDecksByIDs loads the decks among ids with their tags and cards, in
+// four queries however many IDs there are. Unknown IDs are left out.
+func (s *Server) fetchDecksByIDs(ids []string) (map[string]Deck, error) {
+	decks := map[string]*Deck{}
+	var args []interface{}
+	for _, id := range ids {
+		if _, seen := decks[id]; !seen {
+			decks[id] = nil
+			args = append(args, id)
+		}
+	}
+	out := map[string]Deck{}
+	if len(args) == 0 {
+		return out, nil
+	}
+	in := placeholders(len(args))
+
+	rows, err := s.db.Query(`SELECT id, name, description, user_id, slug, is_public, copied_from, parent_id, case_sensitive, archived, default_side FROM decks WHERE id IN (`+in+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		d := &Deck{Cards: []Card{}}
+		var desc, slug, copiedFrom, parentID sql.NullString
+		if err := rows.Scan(&d.ID, &d.Name, &desc, &d.UserID, &slug, &d.IsPublic, &copiedFrom, &parentID, &d.CaseSensitive, &d.Archived, &d.DefaultSide); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Description, d.Slug, d.CopiedFrom, d.ParentID = desc.String, slug.String, copiedFrom.String, parentID.String
+		decks[d.ID] = d
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT dt.deck_id, t.name FROM deck_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.deck_id IN (`+in+`) ORDER BY t.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var deckID, name string
+		if err := rows.Scan(&deckID, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if d := decks[deckID]; d != nil {
+			d.Tags = append(d.Tags, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT id, deck_id, front, back, COALESCE(hint, ''), images, position FROM cards WHERE deck_id IN (`+in+`) ORDER BY position, rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	cardIndex := map[string]int{} // card ID -> index in its deck's Cards
+	for rows.Next() {
+		var c Card
+		var deckID string
+		if err := rows.Scan(&c.ID, &deckID, &c.Front, &c.Back, &c.Hint, (*imageList)(&c.Images), &c.Position); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if d := decks[deckID]; d != nil {
+			cardIndex[c.ID] = len(d.Cards)
+			d.Cards = append(d.Cards, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT c.deck_id, ct.card_id, t.name FROM card_tags ct
+JOIN tags t ON t.id = ct.tag_id
+JOIN cards c ON c.id = ct.card_id
+WHERE c.deck_id IN (`+in+`) ORDER BY t.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deckID, cardID, name string
+		if err := rows.Scan(&deckID, &cardID, &name); err != nil {
+			return nil, err
+		}
+		if d := decks[deckID]; d != nil {
+			c := &d.Cards[cardIndex[cardID]]
+			c.Tags = append(c.Tags, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for id, d := range decks {
+		if d != nil {
+			out[id] = *d
+		}
+	}
+	return out, nil
+}
+
+// attachCardTags fills in Tags for the given cards.
+func (s *Server) attachCardTags(cards []Card) error {
+	if len(cards) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(cards))
+	for i, c := range cards {
+		args[i] = c.ID
+	}
+	rows, err := s.db.Query(`SELECT ct.card_id, t.name FROM card_tags ct
+JOIN tags t ON t.id = ct.tag_id
+WHERE ct.card_id IN (`+placeholders(len(cards))+`) ORDER BY t.name`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byCard := map[string][]string{}
+	for rows.Next() {
+		var cardID, name string
+		if err := rows.Scan(&cardID, &name); err != nil {
+			return err
+		}
+		byCard[cardID] = append(byCard[cardID], name)
+	}
+	for i := range cards {
+		cards[i].Tags = byCard[cards[i].ID]
+	}
+	return rows.Err()
+}
+
+// masteryLevel buckets a card's SM-2 interval for display so clients don't
+// need to interpret raw scheduling numbers. A null interval means the user
+// has never reviewed the card.
+func masteryLevel(interval sql.NullInt64) string {
+	switch {
+	case !interval.Valid:
+		return "new"
+	case interval.Int64 < 1:
+		return "learning"
+	case interval.Int64 < 21:
+		return "young"
+	default:
+		return "mature"
+	}
+}
+
+// difficultyFilters maps ?difficulty= values to a condition on the quality
+// of the user's most recent review. Only these fragments reach the SQL.
+var difficultyFilters = map[string]string{
+	"again": "< 3",
+	"hard":  "= 3",
+	"good":  "= 4",
+	"easy":  "= 5",
+}
+
+// lastQualitySQL is the quality of the user's latest review of card c.
+const lastQualitySQL = `(SELECT rl.quality FROM review_log rl
+WHERE rl.card_id = c.id AND rl.user_id = cs.user_id
+ORDER BY rl.reviewed_at DESC, rl.rowid DESC LIMIT 1)`
+
+// GET /decks/{deckId}/cards?studied=&difficulty=&flag=&flagged=&userId=&limit=&offset=
+// Lists a deck's cards. With studied, only cards the user has (true) or
+// has not (false) reviewed are returned, judged by their schedule row.
+// difficulty (again/hard/good/easy) matches the user's last rating of the
+// card; flag matches one flag value and flagged any flag (or none).
+// Filters combine.
+// With userId, each card also carries the user's masteryLevel.
+func (s *Server) listDeckCardsHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	q := r.URL.Query()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	userID := q.Get("userId")
+	where := "c.deck_id = ?"
+	if v := q.Get("studied"); v != "" {
+		studied, err := strconv.ParseBool(v)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "studied must be true or false"})
+			return
+		}
+		if userID == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required with studied"})
+			return
+		}
+		if studied {
+			where += " AND cs.card_id IS NOT NULL"
+		} else {
+			where += " AND cs.card_id IS NULL"
+		}
+	}
+	if v := q.Get("difficulty"); v != "" {
+		cond, ok := difficultyFilters[v]
+		if !ok {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "difficulty must be one of again, hard, good, easy"})
+			return
+		}
+		if userID == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required with difficulty"})
+			return
+		}
+		where += " AND " + lastQualitySQL + " " + cond
+	}
+	args := []interface{}{userID, deckID}
+	if v := q.Get("flag"); v != "" {
+		if !validCardFlags[v] {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "flag must be one of needs-review, confusing, outdated"})
+			return
+		}
+		where += " AND c.flag = ?"
+		args = append(args, v)
+	}
+	if v := q.Get("flagged"); v != "" {
+		flagged, err := strconv.ParseBool(v)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "flagged must be true or false"})
+			return
+		}
+		if flagged {
+			where += " AND c.flag IS NOT NULL"
+		} else {
+			where += " AND c.flag IS NULL"
+		}
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	from := ` FROM cards c
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE ` + where
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT c.id, c.front, c.back, c.deck_id, COALESCE(c.flag, ''), c.position, cs.interval_days`+from+` ORDER BY c.position, c.rowid LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	cards := []Card{}
+	for rows.Next() {
+		var c Card
+		var interval sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag, &c.Position, &interval); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if userID != "" {
+			c.MasteryLevel = masteryLevel(interval)
+		}
+		cards = append(cards, c)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows.Close()
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, Page{Items: cards, Total: total, Limit: limit, Offset: offset})
+}
+
+type WeeklyGrowth struct {
+	Week       string `json:"week"`
+	Added      int    `json:"added"`
+	Cumulative int    `json:"cumulative"`
+}
+
+// isoWeekKey formats t as an ISO week such as "2024-W03".
+func isoWeekKey(t time.Time) string {
+	y, w := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", y, w)
+}
+
+// startOfISOWeek returns midnight UTC on the Monday of t's ISO week.
+func startOfISOWeek(t time.Time) time.Time {
+	t = t.UTC()
+	offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+}
+
+// GET /decks/{deckId}/growth?weeks=
+// Cards added per ISO week with a running total, covering at most the last
+// `weeks` weeks (default 52, max 260). Cards added earlier, or before
+// creation times were recorded, count toward the starting total.
+func (s *Server) deckGrowthHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	weeks := 52
+	if v := r.URL.Query().Get("weeks"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "weeks must be a positive integer"})
+			return
+		}
+		weeks = min(n, 260)
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, id).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	thisWeek := startOfISOWeek(time.Now())
+	rangeStart := thisWeek.AddDate(0, 0, -7*(weeks-1))
+	rows, err := s.db.Query(`SELECT created_at FROM cards WHERE deck_id = ?`, id)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+
+	baseline := 0
+	added := map[string]int{}
+	first := thisWeek
+	for rows.Next() {
+		var createdAt sql.NullString
+		if err := rows.Scan(&createdAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		t, err := time.Parse(time.RFC3339, createdAt.String)
+		if !createdAt.Valid || err != nil || t.Before(rangeStart) {
+			baseline++
+			continue
+		}
+		added[isoWeekKey(t)]++
+		if wk := startOfISOWeek(t); wk.Before(first) {
+			first = wk
+		}
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if baseline > 0 {
+		first = rangeStart
+	}
+
+	out := []WeeklyGrowth{}
+	total := baseline
+	for wk := first; !wk.After(thisWeek); wk = wk.AddDate(0, 0, 7) {
+		key := isoWeekKey(wk)
+		total += added[key]
+		out = append(out, WeeklyGrowth{Week: key, Added: added[key], Cumulative: total})
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// PatchDiff is the ?diff=true response of a PATCH: the fields whose value
+// changed, with their new values, and the updated resource.
+type PatchDiff struct {
+	Updated  map[string]interface{} `json:"updated"`
+	Resource interface{}            `json:"resource"`
+}
+
+// changedFields compares the JSON forms of before and after and returns the
+// fields that differ, keyed by JSON name, with their values in after. A
+// field dropped by omitempty is reported as null.
+func changedFields(before, after interface{}) (map[string]interface{}, error) {
+	toMap := func(v interface{}) (map[string]interface{}, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		return m, json.Unmarshal(b, &m)
+	}
+	old, err := toMap(before)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := toMap(after)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]interface{}{}
+	for k, v := range cur {
+		if !reflect.DeepEqual(old[k], v) {
+			changed[k] = v
+		}
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			changed[k] = nil
+		}
+	}
+	return changed, nil
+}
+
+// parseDiffParam reads the ?diff= flag of PATCH handlers.
+func parseDiffParam(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("diff")
+	if v == "" {
+		return false, nil
+	}
+	diff, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("diff must be true or false")
+	}
+	return diff, nil
+}
+
+// PATCH /decks/{deckId}?diff=  (partial)
+// With diff=true the response is a PatchDiff instead of the bare deck. The
+// change is audited under the user named by the access token.
+func (s *Server) patchDeckHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	diff, err := parseDiffParam(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	actorID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	var patch struct {
+		Name          *string `json:"name"`
+		Description   *string `json:"description"`
+		IsPublic      *bool   `json:"isPublic"`
+		CaseSensitive *bool   `json:"caseSensitive"`
+		Archived      *bool   `json:"archived"`
+		DefaultSide   *string `json:"defaultSide"`
+		ParentID      *string `json:"parentId"` // "" moves the deck to the top level
+	}
+	if err := decodeJSON(r, &patch); err != nil && !errors.Is(err, errEmptyBody) {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if patch.Name != nil && strings.TrimSpace(*patch.Name) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "name cannot be empty"})
+		return
+	}
+	if patch.DefaultSide != nil && *patch.DefaultSide != "front" && *patch.DefaultSide != "back" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "defaultSide must be front or back"})
+		return
+	}
+	updates := map[string]interface{}{}
+	if patch.Name != nil {
+		updates["name"] = *patch.Name
+	}
+	if patch.Description != nil {
+		updates["description"] = *patch.Description
+	}
+	if patch.IsPublic != nil {
+		updates["is_public"] = *patch.IsPublic
+	}
+	if patch.CaseSensitive != nil {
+		updates["case_sensitive"] = *patch.CaseSensitive
+	}
+	if patch.Archived != nil {
+		updates["archived"] = *patch.Archived
+	}
+	if patch.DefaultSide != nil {
+		updates["default_side"] = *patch.DefaultSide
+	}
+	if patch.ParentID != nil {
+		if *patch.ParentID == "" {
+			updates["parent_id"] = nil
+		} else {
+			updates["parent_id"] = *patch.ParentID
+		}
+	}
+	if len(updates) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	reparent := patch.ParentID != nil && *patch.ParentID != ""
+	publish := patch.IsPublic != nil && *patch.IsPublic
+	if reparent || publish {
+		var ownerID string
+		if err := s.db.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, id).Scan(&ownerID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+				return
+			}
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if publish && s.rejectIfUnverified(r, ownerID) {
+			return
+		}
+		if reparent {
+			if err := checkDeckParent(s.db, id, ownerID, *patch.ParentID); err != nil {
+				setTxError(r.Context(), err)
+				return
+			}
+		}
+	}
+	var before Deck
+	if diff {
+		if before, err = s.fetchDeckByID(id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+				return
+			}
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+	}
+	setParts := []string{}
+	args := []interface{}{}
+	for k, v := range updates {
+		setParts = append(setParts, fmt.Sprintf("%s = ?", k))
+		args = append(args, v)
+	}
+	args = append(args, id)
+	query := fmt.Sprintf("UPDATE decks SET %s WHERE id = ?", strings.Join(setParts, ", "))
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		setTxError(r.Context(), err) // a rename can hit idx_decks_user_name
+		return
+	}
+	rowsAff, _ := res.RowsAffected()
+	if rowsAff == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+		return
+	}
+	s.recordAudit(id, actorID, "deck.update", updates)
+	d, err := s.fetchDeckByID(id)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if diff {
+		changed, err := changedFields(before, d)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "encode error"})
+			return
+		}
+		s.respondJSON(w, http.StatusOK, PatchDiff{Updated: changed, Resource: d})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, d)
+}
+
+// maxDeckDepth bounds the walk up a deck's ancestors. Deeper nesting than
+// this is refused; it also stops the walk should a cycle exist anyway.
+const maxDeckDepth = 32
+
+// checkDeckParent reports, as an AppError, why parentID can't be the parent
+// of deckID: it must be another existing deck of the same owner, and not
+// deckID itself or one of its descendants.
+func checkDeckParent(q queryRower, deckID, ownerID, parentID string) error {
+	if parentID == deckID {
+		return AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "a deck cannot be its own parent"}
+	}
+	var parentOwner string
+	if err := q.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, parentID).Scan(&parentOwner); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "parent deck does not exist"}
+		}
+		return err
+	}
+	if parentOwner != ownerID {
+		return AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "parent deck belongs to another user"}
+	}
+	ancestor := parentID
+	for depth := 0; ; depth++ {
+		if depth >= maxDeckDepth {
+			return AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("decks can be nested at most %d deep", maxDeckDepth)}
+		}
+		var next sql.NullString
+		if err := q.QueryRow(`SELECT parent_id FROM decks WHERE id = ?`, ancestor).Scan(&next); err != nil {
+			return err
+		}
+		if !next.Valid {
+			return nil
+		}
+		if next.String == deckID {
+			return AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "parentId would create a cycle"}
+		}
+		ancestor = next.String
+	}
+}
+
+// maxBatchDecks caps how many decks one batch-update may touch.
+const maxBatchDecks = 500
+
+// POST /decks/batch-update?userId=
+// Body: {"deckIds": [...], "archived": true, "isPublic": false}; at least one
+// of archived/isPublic. Decks not owned by userId are skipped, and the
+// response reports how many were actually updated.
+func (s *Server) batchUpdateDecksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var req struct {
+		DeckIDs  []string `json:"deckIds"`
+		Archived *bool    `json:"archived"`
+		IsPublic *bool    `json:"isPublic"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len(req.DeckIDs) == 0 || len(req.DeckIDs) > maxBatchDecks {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("deckIds must list 1 to %d decks", maxBatchDecks)})
+		return
+	}
+	// Only these columns can be set in bulk.
+	updates := map[string]interface{}{}
+	if req.Archived != nil {
+		updates["archived"] = *req.Archived
+	}
+	if req.IsPublic != nil {
+		updates["is_public"] = *req.IsPublic
+	}
+	if len(updates) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	if req.IsPublic != nil && *req.IsPublic && s.rejectIfUnverified(r, userID) {
+		return
+	}
+	setParts := []string{}
+	args := []interface{}{}
+	for k, v := range updates {
+		setParts = append(setParts, fmt.Sprintf("%s = ?", k))
+		args = append(args, v)
+	}
+	args = append(args, userID)
+	for _, id := range req.DeckIDs {
+		args = append(args, id)
+	}
+
+	var updated []string
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		rows, err := tx.Query(`UPDATE decks SET `+strings.Join(setParts, ", ")+`
+WHERE user_id = ? AND id IN (`+placeholders(len(req.DeckIDs))+`) RETURNING id`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			updated = append(updated, id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	for _, id := range updated {
+		s.recordAudit(id, userID, "deck.update", updates)
+	}
+	s.respondJSON(w, http.StatusOK, map[string]int{"updated": len(updated)})
+}
+
+// PATCH /decks/{deckId}/cards/reorder
+// Body: {"positions": [{"cardId": "a", "position": 0}, ...]}. Only the listed
+// cards move; the update is rejected if two cards would share a position.
+func (s *Server) reorderCardsHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	actorID, ok := s.requireDeckEditor(r, deckID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Positions []struct {
+			CardID   string `json:"cardId"`
+			Position *int   `json:"position"`
+		} `json:"positions"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len(req.Positions) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "positions required"})
+		return
+	}
+	seen := map[string]bool{}
+	for _, p := range req.Positions {
+		if p.CardID == "" || p.Position == nil || *p.Position < 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "each position needs a cardId and a non-negative position"})
+			return
+		}
+		if seen[p.CardID] {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "duplicate cardId " + p.CardID})
+			return
+		}
+		seen[p.CardID] = true
+	}
+
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var tmp string
+		if err := tx.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"}
+			}
+			return err
+		}
+		for _, p := range req.Positions {
+			res, err := tx.Exec(`UPDATE cards SET position = ? WHERE id = ? AND deck_id = ?`, *p.Position, p.CardID, deckID)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return AppError{Code: ErrCodeCardNotFound, Status: http.StatusBadRequest, Msg: "card " + p.CardID + " is not in this deck"}
+			}
+		}
+		var clash int
+		err := tx.QueryRow(`SELECT position FROM cards WHERE deck_id = ? GROUP BY position HAVING COUNT(*) > 1 LIMIT 1`, deckID).Scan(&clash)
+		if err == nil {
+			return AppError{Code: ErrCodePositionConflict, Status: http.StatusConflict, Msg: fmt.Sprintf("more than one card at position %d", clash)}
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, actorID, "cards.reorder", req.Positions)
+	d, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, d)
+}
+
+// DELETE /decks/{deckId}
+func (s *Server) deleteDeckHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	res, err := s.db.Exec(`DELETE FROM decks WHERE id = ?`, id)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------- Handlers: Deck templates ---------- */
+
+// DeckTemplate turns structured card fields into card text. Front and Back
+// are text/template sources executed with the card's fields, e.g.
+// "{{.word}}" and "{{.definition}}".
+type DeckTemplate struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	FieldNames []string `json:"fieldNames"`
+	Front      string   `json:"front"`
+	Back       string   `json:"back"`
+	CreatedAt  string   `json:"createdAt"`
+}
+
+// templateFieldPattern keeps field names usable as {{.name}} in templates.
+var templateFieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// render executes the template's front and back with fields, which must
+// hold exactly the template's field names.
+func (t DeckTemplate) render(fields map[string]string) (front, back string, err error) {
+	for _, name := range t.FieldNames {
+		if _, ok := fields[name]; !ok {
+			return "", "", fmt.Errorf("missing field %q", name)
+		}
+	}
+	if len(fields) != len(t.FieldNames) {
+		for name := range fields {
+			if !slices.Contains(t.FieldNames, name) {
+				return "", "", fmt.Errorf("unknown field %q", name)
+			}
+		}
+	}
+	exec := func(name, src string) (string, error) {
+		tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(src)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, fields); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	if front, err = exec("front", t.Front); err != nil {
+		return "", "", err
+	}
+	if back, err = exec("back", t.Back); err != nil {
+		return "", "", err
+	}
+	return front, back, nil
+}
+
+// fetchDeckTemplate loads a template by ID; sql.ErrNoRows if there is none.
+func (s *Server) fetchDeckTemplate(id string) (DeckTemplate, error) {
+	var t DeckTemplate
+	var fieldNames string
+	err := s.db.QueryRow(`SELECT id, name, field_names, front_template, back_template, created_at FROM deck_templates WHERE id = ?`, id).
+		Scan(&t.ID, &t.Name, &fieldNames, &t.Front, &t.Back, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal([]byte(fieldNames), &t.FieldNames)
+}
+
+// POST /deck-templates
+// body: { name, fieldNames, front, back }
+// The templates are checked by rendering them with every field set, so a
+// reference to an undeclared field is rejected here rather than per card.
+func (s *Server) createDeckTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var t DeckTemplate
+	if err := decodeJSON(r, &t); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(t.Name) == "" || strings.TrimSpace(t.Front) == "" || strings.TrimSpace(t.Back) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "name, front and back required"})
+		return
+	}
+	if len(t.FieldNames) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "fieldNames required"})
+		return
+	}
+	sample := map[string]string{}
+	for _, name := range t.FieldNames {
+		if !templateFieldPattern.MatchString(name) {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("field name %q must be letters, digits and underscores", name)})
+			return
+		}
+		if _, dup := sample[name]; dup {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("duplicate field name %q", name)})
+			return
+		}
+		sample[name] = name
+	}
+	if _, _, err := t.render(sample); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid template: " + err.Error()})
+		return
+	}
+	t.ID = genID()
+	t.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	fieldNames, _ := json.Marshal(t.FieldNames)
+	if _, err := s.db.Exec(`INSERT INTO deck_templates(id, name, field_names, front_template, back_template, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, string(fieldNames), t.Front, t.Back, t.CreatedAt); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, t)
+}
+
+// GET /deck-templates/{templateId}
+func (s *Server) getDeckTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.fetchDeckTemplate(chi.URLParam(r, "templateId"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeTemplateNotFound, Status: http.StatusNotFound, Msg: "template not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, t)
+}
+
+// POST /decks/from-template
+// body: { templateId, userId, name, description, cards: [{ fields: {...} }] }
+// Renders each card's fields through the template and creates the deck
+// with the resulting cards.
+func (s *Server) createDeckFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TemplateID  string `json:"templateId"`
+		UserID      string `json:"userId"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Cards       []struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"cards"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.TemplateID) == "" || strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.UserID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "templateId, name and userId required"})
+		return
+	}
+	tmpl, err := s.fetchDeckTemplate(req.TemplateID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "template does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	cards := make([]CardRequest, 0, len(req.Cards))
+	for i, c := range req.Cards {
+		front, back, err := tmpl.render(c.Fields)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("cards[%d]: %v", i, err)})
+			return
+		}
+		if strings.TrimSpace(front) == "" || strings.TrimSpace(back) == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("cards[%d]: front/back render empty", i)})
+			return
+		}
+		cards = append(cards, CardRequest{Front: front, Back: back})
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	deckID := genID()
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := insertWithSlug(req.Name, deckID, func(slug string) error {
+			_, err := tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug) VALUES (?, ?, ?, ?, ?)`,
+				deckID, req.Name, req.Description, req.UserID, slug)
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, c := range cards {
+			if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, genID(), deckID, c.Front, c.Back); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, req.UserID, "deck.create", map[string]interface{}{"name": req.Name, "cards": len(cards), "templateId": tmpl.ID})
+
+	deck, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, deck)
+}
+
+/* ---------- Handlers: Collections ---------- */
+
+// Collection is an ordered group of one user's decks, studied together
+// through GET /study/next?collectionId=.
+type Collection struct {
+	ID          string           `json:"id"`
+	UserID      string           `json:"userId"`
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	CreatedAt   string           `json:"createdAt"`
+	Decks       []CollectionDeck `json:"decks"`
+}
+
+// CollectionDeck is a deck's place in a collection.
+type CollectionDeck struct {
+	DeckID   string `json:"deckId"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+}
+
+func (s *Server) fetchCollection(id string) (Collection, error) {
+	var c Collection
+	var desc sql.NullString
+	err := s.db.QueryRow(`SELECT id, user_id, name, description, created_at FROM collections WHERE id = ?`, id).
+		Scan(&c.ID, &c.UserID, &c.Name, &desc, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.Description = desc.String
+	rows, err := s.db.Query(`SELECT cd.deck_id, d.name, cd.position FROM collection_decks cd
+JOIN decks d ON d.id = cd.deck_id
+WHERE cd.collection_id = ? ORDER BY cd.position`, id)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	c.Decks = []CollectionDeck{}
+	for rows.Next() {
+		var cd CollectionDeck
+		if err := rows.Scan(&cd.DeckID, &cd.Name, &cd.Position); err != nil {
+			return c, err
+		}
+		c.Decks = append(c.Decks, cd)
+	}
+	return c, rows.Err()
+}
+
+// respondCollection writes the collection, or 404 when it doesn't exist.
+func (s *Server) respondCollection(w http.ResponseWriter, r *http.Request, status int, id string) {
+	c, err := s.fetchCollection(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, status, c)
+}
+
+// POST /collections
+// body: { userId, name, description? }
+func (s *Server) createCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID      string `json:"userId"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.UserID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "name and userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	id := genID()
+	var desc interface{}
+	if req.Description != "" {
+		desc = req.Description
+	}
+	if _, err := s.db.Exec(`INSERT INTO collections(id, user_id, name, description, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id, req.UserID, req.Name, desc, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondCollection(w, r, http.StatusCreated, id)
+}
+
+// GET /collections/{collectionId}
+func (s *Server) getCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	s.respondCollection(w, r, http.StatusOK, chi.URLParam(r, "collectionId"))
+}
+
+// PATCH /collections/{collectionId}
+// body: { name?, description? }; an empty description clears it.
+func (s *Server) patchCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "collectionId")
+	var patch struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := decodeJSON(r, &patch); err != nil && !errors.Is(err, errEmptyBody) {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if patch.Name != nil && strings.TrimSpace(*patch.Name) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "name cannot be empty"})
+		return
+	}
+	setParts := []string{}
+	args := []interface{}{}
+	if patch.Name != nil {
+		setParts = append(setParts, "name = ?")
+		args = append(args, *patch.Name)
+	}
+	if patch.Description != nil {
+		setParts = append(setParts, "description = ?")
+		if *patch.Description == "" {
+			args = append(args, nil)
+		} else {
+			args = append(args, *patch.Description)
+		}
+	}
+	if len(setParts) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	res, err := s.db.Exec(`UPDATE collections SET `+strings.Join(setParts, ", ")+` WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"})
+		return
+	}
+	s.respondCollection(w, r, http.StatusOK, id)
+}
+
+// DELETE /collections/{collectionId}
+// The decks themselves are left alone.
+func (s *Server) deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.db.Exec(`DELETE FROM collections WHERE id = ?`, chi.URLParam(r, "collectionId"))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /collections/{collectionId}/decks
+// body: { deckId }
+// Appends one of the collection owner's decks; adding a deck that is already
+// in the collection leaves it where it is. Responds with the collection.
+func (s *Server) addCollectionDeckHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "collectionId")
+	var req struct {
+		DeckID string `json:"deckId"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.DeckID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deckId required"})
+		return
+	}
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var ownerID string
+		if err := tx.QueryRow(`SELECT user_id FROM collections WHERE id = ?`, id).Scan(&ownerID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"}
+			}
+			return err
+		}
+		var deckOwner string
+		if err := tx.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, req.DeckID).Scan(&deckOwner); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "deck does not exist"}
+			}
+			return err
+		}
+		if deckOwner != ownerID {
+			return AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "deck belongs to another user"}
+		}
+		_, err := tx.Exec(`INSERT OR IGNORE INTO collection_decks(collection_id, deck_id, position)
+SELECT ?, ?, COALESCE(MAX(position), -1) + 1 FROM collection_decks WHERE collection_id = ?`, id, req.DeckID, id)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondCollection(w, r, http.StatusOK, id)
+}
+
+// DELETE /collections/{collectionId}/decks/{deckId}
+func (s *Server) removeCollectionDeckHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.db.Exec(`DELETE FROM collection_decks WHERE collection_id = ? AND deck_id = ?`,
+		chi.URLParam(r, "collectionId"), chi.URLParam(r, "deckId"))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not in collection"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CollectionStudyQueue is the due cards of a collection, grouped by deck in
+// collection order.
+type CollectionStudyQueue struct {
+	Decks []CollectionStudyDeck `json:"decks"`
+}
+
+// CollectionStudyDeck is one deck's section of a CollectionStudyQueue.
+type CollectionStudyDeck struct {
+	DeckID   string         `json:"deckId"`
+	DeckName string         `json:"deckName"`
+	Cards    []DueStudyCard `json:"cards"`
+}
+
+// DueStudyCard is a due card with the time it fell due.
+type DueStudyCard struct {
+	Card
+	DueAt string `json:"dueAt"`
+}
+
+// GET /collections/{collectionId}/study?userId=&tz=
+// Every card of the collection due for the user, by deck position and then
+// due date, up to what is left of the user's daily reviewLimit. Decks with
+// nothing due are left out.
+func (s *Server) collectionStudyHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "collectionId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM collections WHERE id = ?`, id).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	prefs, err := fetchPreferences(s.db, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
+	}
+	reviewed, _, err := s.studiedToday(userID, loc)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT c.id, c.front, c.back, c.deck_id, COALESCE(c.hint, ''), c.images, d.name, cs.due_at
+FROM collection_decks cd
+JOIN decks d ON d.id = cd.deck_id
+JOIN cards c ON c.deck_id = d.id
+JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE cd.collection_id = ? AND cs.due_at <= ?
+ORDER BY cd.position, cs.due_at, c.rowid
+LIMIT ?`, userID, id, time.Now().UTC().Format(time.RFC3339), max(prefs.ReviewLimit-reviewed, 0))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	cards := []Card{}
+	var deckNames, dues []string
+	for rows.Next() {
+		var c Card
+		var deckName, due string
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Hint, (*imageList)(&c.Images), &deckName, &due); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		cards = append(cards, c)
+		deckNames = append(deckNames, deckName)
+		dues = append(dues, due)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	queue := CollectionStudyQueue{Decks: []CollectionStudyDeck{}}
+	for i, c := range cards {
+		// Rows arrive grouped by deck, so a new deck starts a new section.
+		if n := len(queue.Decks); n == 0 || queue.Decks[n-1].DeckID != c.DeckID {
+			queue.Decks = append(queue.Decks, CollectionStudyDeck{DeckID: c.DeckID, DeckName: deckNames[i]})
+		}
+		sec := &queue.Decks[len(queue.Decks)-1]
+		sec.Cards = append(sec.Cards, DueStudyCard{Card: c, DueAt: dues[i]})
+	}
+	s.respondJSON(w, http.StatusOK, queue)
+}
+
+/* ---------- Handlers: Markdown import/export ---------- */
+
+// Markdown layout:
+//
+//	# Deck name
+//
+//	Description paragraph
+//
+//	## Card front
+//
+//	Card back, possibly
+//	over several lines
+//
+// Back lines starting with '#' are escaped with a backslash so they aren't
+// read back as headings.
+
+// GET /decks/{deckId}/export.md
+func (s *Server) exportDeckMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	d, err := s.fetchDeckByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, deckToMarkdown(d))
+}
+
+func deckToMarkdown(d Deck) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", singleLine(d.Name))
+	if strings.TrimSpace(d.Description) != "" {
+		fmt.Fprintf(&b, "\n%s\n", escapeMarkdownBody(d.Description))
+	}
+	for _, c := range d.Cards {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", singleLine(c.Front), escapeMarkdownBody(c.Back))
+	}
+	return b.String()
+}
+
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func escapeMarkdownBody(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, "#") || strings.HasPrefix(l, `\`) {
+			lines[i] = `\` + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseDeckMarkdown is the inverse of deckToMarkdown.
+func parseDeckMarkdown(src string) (name, description string, cards []CardRequest, err error) {
+	var body []string
+	var current *CardRequest
+	flush := func() {
+		text := strings.TrimSpace(strings.Join(body, "\n"))
+		body = nil
+		if current == nil {
+			description = text
+			return
+		}
+		current.Back = text
+		cards = append(cards, *current)
+	}
+
+	seenTitle := false
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "## "):
+			if !seenTitle {
+				return "", "", nil, errors.New("missing '# ' deck title")
+			}
+			flush()
+			current = &CardRequest{Front: strings.TrimSpace(line[3:])}
+		case strings.HasPrefix(line, "# ") && !seenTitle:
+			name = strings.TrimSpace(line[2:])
+			seenTitle = true
+		case strings.HasPrefix(line, `\`):
+			body = append(body, line[1:])
+		default:
+			if !seenTitle && strings.TrimSpace(line) != "" {
+				return "", "", nil, errors.New("missing '# ' deck title")
+			}
+			body = append(body, line)
+		}
+	}
+	if !seenTitle {
+		return "", "", nil, errors.New("missing '# ' deck title")
+	}
+	flush()
+	return name, description, cards, nil
+}
+
+// POST /decks/import/markdown?userId=
+// body: Markdown in the export.md layout
+func (s *Server) importDeckMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	src, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "could not read body"})
+		return
+	}
+	name, description, cards, err := parseDeckMarkdown(string(src))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if name == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deck name required"})
+		return
+	}
+	for _, c := range cards {
+		if strings.TrimSpace(c.Front) == "" || strings.TrimSpace(c.Back) == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "card front/back required"})
+			return
+		}
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	deckID := genID()
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := insertWithSlug(name, deckID, func(slug string) error {
+			_, err := tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug) VALUES (?, ?, ?, ?, ?)`, deckID, name, description, userID, slug)
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, c := range cards {
+			if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, genID(), deckID, c.Front, c.Back); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, userID, "deck.import", map[string]interface{}{"format": "markdown", "cards": len(cards)})
+
+	deck, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, deck)
+}
+
+// POST /decks/import/json?userId=
+// body: { name, description?, cards: [{ front, back, tags? }] }
+// Accepts the shape returned by GET /decks/{deckId}, so decks round-trip with their tags.
+func (s *Server) importDeckJSONHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var req struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		Cards       []CardRequest `json:"cards"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deck name required"})
+		return
+	}
+	for _, c := range req.Cards {
+		if strings.TrimSpace(c.Front) == "" || strings.TrimSpace(c.Back) == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "card front/back required"})
+			return
+		}
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	deckID := genID()
+	tagsCreated := 0
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := insertWithSlug(req.Name, deckID, func(slug string) error {
+			_, err := tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug) VALUES (?, ?, ?, ?, ?)`, deckID, req.Name, req.Description, userID, slug)
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, c := range req.Cards {
+			cardID := genID()
+			if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, cardID, deckID, c.Front, c.Back); err != nil {
+				return err
+			}
+			n, err := tagCard(tx, cardID, c.Tags)
+			if err != nil {
+				return err
+			}
+			tagsCreated += n
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, userID, "deck.import", map[string]interface{}{"format": "json", "cards": len(req.Cards)})
+
+	deck, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"deck":        deck,
+		"tagsCreated": tagsCreated,
+	})
+}
+
+/* ---------- Handlers: Schedule export/import ---------- */
+
+// Card IDs change when decks are exported and re-imported, so schedules
+// travel keyed by deck name and card front. Fronts are matched after
+// trimming and case-folding.
+
+// ScheduleExport is the document served by GET /users/{userId}/schedules.json.
+type ScheduleExport struct {
+	ExportedAt string                `json:"exportedAt"`
+	Schedules  []ScheduleExportEntry `json:"schedules"`
+}
+
+type ScheduleExportEntry struct {
+	DeckName       string  `json:"deckName"`
+	Front          string  `json:"front"`
+	EaseFactor     float64 `json:"easeFactor"`
+	Interval       int     `json:"interval"`
+	Repetitions    int     `json:"repetitions"`
+	DueAt          string  `json:"dueAt"`
+	LastReviewedAt string  `json:"lastReviewedAt,omitempty"`
+}
+
+// GET /users/{userId}/schedules.json
+// Downloads the user's review schedules for every card they have studied.
+func (s *Server) exportSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.name, c.front, cs.ease_factor, cs.interval_days, cs.repetitions, cs.due_at, COALESCE(cs.last_reviewed_at, '')
+FROM card_schedules cs
+JOIN cards c ON c.id = cs.card_id
+JOIN decks d ON d.id = c.deck_id
+WHERE cs.user_id = ?
+ORDER BY d.name, c.position, c.rowid`, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	doc := ScheduleExport{ExportedAt: time.Now().UTC().Format(time.RFC3339), Schedules: []ScheduleExportEntry{}}
+	for rows.Next() {
+		var e ScheduleExportEntry
+		if err := rows.Scan(&e.DeckName, &e.Front, &e.EaseFactor, &e.Interval, &e.Repetitions, &e.DueAt, &e.LastReviewedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		doc.Schedules = append(doc.Schedules, e)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	// A file download, so it is never wrapped in the response envelope.
+	w.Header().Set("Content-Disposition", `attachment; filename="schedules.json"`)
+	s.writeJSON(w, http.StatusOK, doc)
+}
+
+// POST /users/{userId}/schedules/import
+// body: a document from GET /users/{userId}/schedules.json
+// Applies each entry to the cards with that front in the user's own decks of
+// that name, typically right after importing the decks. Entries without a
+// matching card are skipped. All-or-nothing.
+func (s *Server) importSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var doc ScheduleExport
+	if err := decodeJSON(r, &doc); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	for i, e := range doc.Schedules {
+		if strings.TrimSpace(e.DeckName) == "" || strings.TrimSpace(e.Front) == "" {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("schedules[%d]: deckName and front required", i)})
+			return
+		}
+		if e.EaseFactor < 1.3 || e.Interval < 0 || e.Repetitions < 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("schedules[%d]: invalid SM-2 values", i)})
+			return
+		}
+		if _, err := time.Parse(time.RFC3339, e.DueAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("schedules[%d]: dueAt must be an RFC 3339 time", i)})
+			return
+		}
+	}
+	matched, applied := 0, 0
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var tmp string
+		if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"}
+			}
+			return err
+		}
+		for _, e := range doc.Schedules {
+			var last interface{}
+			if e.LastReviewedAt != "" {
+				last = e.LastReviewedAt
+			}
+			res, err := tx.Exec(`INSERT INTO card_schedules(card_id, user_id, ease_factor, interval_days, repetitions, due_at, last_reviewed_at)
+SELECT c.id, ?, ?, ?, ?, ?, ? FROM cards c JOIN decks d ON d.id = c.deck_id
+WHERE d.user_id = ? AND d.name = ? AND LOWER(TRIM(c.front)) = LOWER(TRIM(?))
+ON CONFLICT(card_id, user_id) DO UPDATE SET ease_factor = excluded.ease_factor, interval_days = excluded.interval_days,
+    repetitions = excluded.repetitions, due_at = excluded.due_at, last_reviewed_at = excluded.last_reviewed_at`,
+				userID, e.EaseFactor, e.Interval, e.Repetitions, e.DueAt, last, userID, e.DeckName, e.Front)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				matched++
+				applied += int(n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]int{
+		"total":   len(doc.Schedules),
+		"matched": matched,
+		"applied": applied,
+	})
+}
+
+/* ---------- Handlers: Collaborators ---------- */
+
+type Collaborator struct {
+	DeckID string `json:"deckId"`
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+// POST /decks/{deckId}/collaborators (owner's access token)
+// body: { userId, role: "viewer" | "editor" }
+// Inviting an existing collaborator again updates their role.
+func (s *Server) addCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	ownerID, ok := s.requireDeckOwner(r, deckID)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID string `json:"userId"`
+		Role   string `json:"role"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.UserID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	if req.Role != "viewer" && req.Role != "editor" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "role must be viewer or editor"})
+		return
+	}
+	if ownerID == req.UserID {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "owner cannot be a collaborator"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	_, err := s.db.Exec(`INSERT INTO deck_collaborators(deck_id, user_id, role) VALUES (?, ?, ?)
+ON CONFLICT(deck_id, user_id) DO UPDATE SET role = excluded.role`, deckID, req.UserID, req.Role)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.recordAudit(deckID, ownerID, "collaborator.add", map[string]string{"userId": req.UserID, "role": req.Role})
+	s.respondJSON(w, http.StatusCreated, Collaborator{DeckID: deckID, UserID: req.UserID, Role: req.Role})
+}
+
+// DELETE /decks/{deckId}/collaborators/{userId} (owner's access token)
+func (s *Server) removeCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	userID := chi.URLParam(r, "userId")
+	ownerID, ok := s.requireDeckOwner(r, deckID)
+	if !ok {
+		return
+	}
+	res, err := s.db.Exec(`DELETE FROM deck_collaborators WHERE deck_id = ? AND user_id = ?`, deckID, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeCollaboratorNotFound, Status: http.StatusNotFound, Msg: "collaborator not found"})
+		return
+	}
+	s.recordAudit(deckID, ownerID, "collaborator.remove", map[string]string{"userId": userID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /users/{userId}/shared-with-me
+// Decks the user collaborates on but does not own.
+func (s *Server) listSharedDecksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.id FROM decks d
+JOIN deck_collaborators dc ON dc.deck_id = d.id
+WHERE dc.user_id = ? AND d.user_id != ?`, userID, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	decks := []Deck{}
+	for _, id := range ids {
+		d, err := s.fetchDeckByID(id)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		decks = append(decks, d)
+	}
+	s.respondJSON(w, http.StatusOK, decks)
+}
+
+// canEditDeck reports whether userID owns the deck or collaborates on it as an editor.
+func (s *Server) canEditDeck(deckID, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM decks d
+LEFT JOIN deck_collaborators dc ON dc.deck_id = d.id AND dc.user_id = ? AND dc.role = 'editor'
+WHERE d.id = ? AND (d.user_id = ? OR dc.user_id IS NOT NULL)`, userID, deckID, userID).Scan(&n)
+	return n > 0, err
+}
+
+// requireDeckEditor enforces canEditDeck for the user named by the request's
+// access token, and returns that user. It records the error with setError and
+// returns false on failure, including when there is no access token.
+func (s *Server) requireDeckEditor(r *http.Request, deckID string) (string, bool) {
+	userID, ok := s.requireBearerUser(r)
+	if !ok {
+		return "", false
+	}
+	ok, err := s.canEditDeck(deckID, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return "", false
+	}
+	if !ok {
+		setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "not allowed to edit this deck"})
+		return "", false
+	}
+	return userID, true
+}
+
+// requireCardEditor is requireDeckEditor for the deck owning cardID.
+func (s *Server) requireCardEditor(r *http.Request, cardID string) (string, bool) {
+	var deckID string
+	if err := s.db.QueryRow(`SELECT deck_id FROM cards WHERE id = ?`, cardID).Scan(&deckID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return "", false
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return "", false
+	}
+	return s.requireDeckEditor(r, deckID)
+}
+
+// requireDeckOwner admits only the deck's owner, named by the request's
+// access token, and returns them. Editors cannot manage collaborators.
+func (s *Server) requireDeckOwner(r *http.Request, deckID string) (string, bool) {
+	userID, ok := s.requireBearerUser(r)
+	if !ok {
+		return "", false
+	}
+	var ownerID string
+	if err := s.db.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, deckID).Scan(&ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return "", false
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return "", false
+	}
+	if ownerID != userID {
+		setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "only the deck owner can manage collaborators"})
+		return "", false
+	}
+	return userID, true
+}
+
+/* ---------- Handlers: Share links ---------- */
+
+// POST /decks/{deckId}/share-link
+// body (optional): { userId, expiresIn: "24h", maxUses: 10 }
+// Without expiresIn/maxUses the link never expires.
+func (s *Server) createShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	var req struct {
+		UserID    string `json:"userId"`
+		ExpiresIn string `json:"expiresIn"`
+		MaxUses   *int   `json:"maxUses"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil && !errors.Is(err, errEmptyBody) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+			return
+		}
+	}
+	var expiresAt, usesRemaining interface{}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "expiresIn must be a positive duration like \"24h\""})
+			return
+		}
+		expiresAt = time.Now().UTC().Add(d).Format(time.RFC3339)
+	}
+	if req.MaxUses != nil {
+		if *req.MaxUses <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "maxUses must be positive"})
+			return
+		}
+		usesRemaining = *req.MaxUses
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var createdBy interface{}
+	if req.UserID != "" {
+		createdBy = req.UserID
+	}
+
+	var token string
+	for attempt := 0; ; attempt++ {
+		var err error
+		token, err = randomBase58(8)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
+			return
+		}
+		_, err = s.db.Exec(`INSERT INTO share_links(token, deck_id, created_by, expires_at, uses_remaining) VALUES (?, ?, ?, ?, ?)`,
+			token, deckID, createdBy, expiresAt, usesRemaining)
+		if err == nil {
+			break
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		// Retry on the (unlikely) token collision.
+		if !strings.Contains(err.Error(), "UNIQUE") || attempt == 3 {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+	}
+	resp := map[string]interface{}{
+		"token": token,
+		"url":   s.publicBaseURL(r) + "/s/" + token,
+	}
+	if expiresAt != nil {
+		resp["expiresAt"] = expiresAt
+	}
+	if usesRemaining != nil {
+		resp["usesRemaining"] = usesRemaining
+	}
+	s.respondJSON(w, http.StatusCreated, resp)
+}
+
+// GET /s/{token}
+// Each successful visit consumes one use; expired or used-up links are 410 Gone.
+func (s *Server) followShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	var deckID string
+	var expiresAt sql.NullString
+	var usesRemaining sql.NullInt64
+	err := s.db.QueryRow(`SELECT deck_id, expires_at, uses_remaining FROM share_links WHERE token = ?`, token).Scan(&deckID, &expiresAt, &usesRemaining)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeShareLinkNotFound, Status: http.StatusNotFound, Msg: "share link not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if expiresAt.Valid {
+		if t, err := time.Parse(time.RFC3339, expiresAt.String); err == nil && !time.Now().Before(t) {
+			setError(r.Context(), AppError{Code: ErrCodeShareLinkExpired, Status: http.StatusGone, Msg: "share link expired"})
+			return
+		}
+	}
+	if usesRemaining.Valid {
+		// Conditional decrement so concurrent visits can't overdraw the link.
+		res, err := s.db.Exec(`UPDATE share_links SET uses_remaining = uses_remaining - 1 WHERE token = ? AND uses_remaining > 0`, token)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			setError(r.Context(), AppError{Code: ErrCodeShareLinkExhausted, Status: http.StatusGone, Msg: "share link has no uses remaining"})
+			return
+		}
+	}
+	http.Redirect(w, r, "/decks/"+deckID, http.StatusFound)
+}
+
+// cleanupShareLinks deletes expired and used-up share links every interval
+// until ctx is cancelled.
+func (s *Server) cleanupShareLinks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.db.Exec(`DELETE FROM share_links WHERE expires_at <= ? OR uses_remaining <= 0`, time.Now().UTC().Format(time.RFC3339))
+			if err != nil {
+				s.logger.Error("share link cleanup failed", "err", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				s.logger.Info("share link cleanup", "removed", n)
+			}
+		}
+	}
+}
+
+/* ---------- Tags ---------- */
+
+// normalizeTag lowercases and trims a tag name and collapses inner whitespace.
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// tagCard attaches the named tags to a card, creating tags that don't exist
+// yet. It returns how many tags were created.
+func tagCard(tx *sql.Tx, cardID string, names []string) (int, error) {
+	created := 0
+	for _, name := range names {
+		name = normalizeTag(name)
+		if name == "" {
+			continue
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO tags(id, name) VALUES (?, ?)`, genID(), name)
+		if err != nil {
+			return created, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			created++
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO card_tags(card_id, tag_id) SELECT ?, id FROM tags WHERE name = ?`, cardID, name); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+/* ---------- Handlers: Deck tags ---------- */
+
+// deckTagParam reads and normalizes the {tag} URL parameter.
+func deckTagParam(r *http.Request) (string, error) {
+	tag := normalizeTag(chi.URLParam(r, "tag"))
+	if tag == "" {
+		return "", errors.New("tag cannot be empty")
+	}
+	return tag, nil
+}
+
+// POST /decks/{deckId}/tags/{tag}
+// Tags the deck, creating the tag if needed; tagging twice is a no-op.
+// Responds with the deck.
+func (s *Server) addDeckTagHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	tag, err := deckTagParam(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	actorID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var added int64
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO tags(id, name) VALUES (?, ?)`, genID(), tag); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO deck_tags(deck_id, tag_id) SELECT ?, id FROM tags WHERE name = ?`, deckID, tag)
+		if err != nil {
+			return err
+		}
+		added, _ = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	if added > 0 {
+		s.recordAudit(deckID, actorID, "deck.tag", map[string]string{"tag": tag})
+	}
+	d, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, d)
+}
+
+// DELETE /decks/{deckId}/tags/{tag}
+// The tag itself is kept; cards and other decks may still use it.
+func (s *Server) removeDeckTagHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	tag, err := deckTagParam(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	actorID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	res, err := s.db.Exec(`DELETE FROM deck_tags WHERE deck_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)`, deckID, tag)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeTagNotFound, Status: http.StatusNotFound, Msg: "deck does not have this tag"})
+		return
+	}
+	s.recordAudit(deckID, actorID, "deck.untag", map[string]string{"tag": tag})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------- Handlers: Public decks ---------- */
+
+// PublicDeck is a public deck as listed by GET /public/decks.
+type PublicDeck struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Slug        string `json:"slug,omitempty"`
+	UserID      string `json:"userId"`
+	CardCount   int    `json:"cardCount"`
+	CopyCount   int    `json:"copyCount"`
+}
+
+// GET /public/decks?tag=&limit=&offset=
+// Unarchived public decks, most copied first. With tag, only decks tagged
+// with it or having at least one card with it; an unknown tag yields an
+// empty page.
+func (s *Server) listPublicDecksHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	where := "d.is_public = 1 AND d.archived = 0"
+	args := []interface{}{}
+	if v := r.URL.Query().Get("tag"); v != "" {
+		where += ` AND (EXISTS (SELECT 1 FROM deck_tags dt
+    JOIN tags t ON t.id = dt.tag_id
+    WHERE dt.deck_id = d.id AND t.name = ?)
+  OR EXISTS (SELECT 1 FROM cards c
+    JOIN card_tags ct ON ct.card_id = c.id
+    JOIN tags t ON t.id = ct.tag_id
+    WHERE c.deck_id = d.id AND t.name = ?))`
+		tag := normalizeTag(v)
+		args = append(args, tag, tag)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM decks d WHERE `+where, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.id, d.name, COALESCE(d.description, ''), COALESCE(d.slug, ''), d.user_id,
+    (SELECT COUNT(*) FROM cards c WHERE c.deck_id = d.id),
+    (SELECT COUNT(*) FROM decks cp WHERE cp.copied_from = d.id) AS copies
+FROM decks d WHERE `+where+`
+ORDER BY copies DESC, d.name, d.rowid LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	decks := []PublicDeck{}
+	for rows.Next() {
+		var d PublicDeck
+		if err := rows.Scan(&d.ID, &d.Name, &d.Description, &d.Slug, &d.UserID, &d.CardCount, &d.CopyCount); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		decks = append(decks, d)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, Page{Items: decks, Total: total, Limit: limit, Offset: offset})
+}
+
+// RecentDeck is an entry of the GET /public/decks/recent feed.
+type RecentDeck struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Slug        string `json:"slug,omitempty"`
+	UserID      string `json:"userId"`
+	Username    string `json:"username"`
+	CardCount   int    `json:"cardCount"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// GET /public/decks/recent?limit=
+// The newest unarchived public decks (default 20, max 100), with their
+// owner's username. Decks created before created_at was recorded are left
+// out.
+func (s *Server) recentPublicDecksHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, 100)
+	}
+	rows, err := s.db.Query(`SELECT d.id, d.name, COALESCE(d.description, ''), COALESCE(d.slug, ''), d.user_id, u.username,
+    (SELECT COUNT(*) FROM cards c WHERE c.deck_id = d.id), d.created_at
+FROM decks d JOIN users u ON u.id = d.user_id
+WHERE d.is_public = 1 AND d.archived = 0 AND d.created_at IS NOT NULL
+ORDER BY d.created_at DESC, d.rowid DESC
+LIMIT ?`, limit)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	decks := []RecentDeck{}
+	for rows.Next() {
+		var d RecentDeck
+		if err := rows.Scan(&d.ID, &d.Name, &d.Description, &d.Slug, &d.UserID, &d.Username, &d.CardCount, &d.CreatedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		decks = append(decks, d)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, decks)
+}
+
+// POST /public/decks/{deckId}/copy
+// Copies a public deck and its cards into the library of the user named by
+// the access token, with fresh IDs.
+func (s *Server) copyPublicDeckHandler(w http.ResponseWriter, r *http.Request) {
+	srcID := chi.URLParam(r, "deckId")
+	userID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	src, err := s.fetchDeckByID(srcID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if !src.IsPublic {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotPublic, Status: http.StatusForbidden, Msg: "deck is not public"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	deckID := genID()
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		// Copying the same deck twice gives "Name (2)" rather than a conflict.
+		name, err := availableDeckName(tx, userID, src.Name)
+		if err != nil {
+			return err
+		}
+		if err := insertWithSlug(name, deckID, func(slug string) error {
+			_, err := tx.Exec(`INSERT INTO decks(id, name, description, user_id, slug, copied_from) VALUES (?, ?, ?, ?, ?, ?)`,
+				deckID, name, src.Description, userID, slug, src.ID)
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, c := range src.Cards {
+			cardID := genID()
+			if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back, hint, images) VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`, cardID, deckID, c.Front, c.Back, c.Hint, imageList(c.Images)); err != nil {
+				return err
+			}
+			if _, err := tagCard(tx, cardID, c.Tags); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, userID, "deck.copy", map[string]string{"sourceDeckId": src.ID})
+
+	deck, err := s.fetchDeckByID(deckID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, deck)
+}
+
+// DeckSuggestion is a public deck recommended from tag overlap.
+type DeckSuggestion struct {
+	DeckID      string `json:"deckId"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Slug        string `json:"slug,omitempty"`
+	SharedTags  int    `json:"sharedTags"`
+}
+
+// GET /users/{userId}/suggestions?limit=
+// Public decks whose cards share tags with the user's own decks, most shared
+// tags first. Decks the user owns or has already copied are left out.
+func (s *Server) deckSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, 50)
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`WITH user_tags AS (
+    SELECT DISTINCT ct.tag_id FROM card_tags ct
+    JOIN cards c ON c.id = ct.card_id
+    JOIN decks d ON d.id = c.deck_id
+    WHERE d.user_id = ?
+)
+SELECT d.id, d.name, COALESCE(d.description, ''), COALESCE(d.slug, ''), COUNT(DISTINCT ct.tag_id) AS overlap
+FROM decks d
+JOIN cards c ON c.deck_id = d.id
+JOIN card_tags ct ON ct.card_id = c.id
+WHERE d.is_public = 1 AND d.archived = 0 AND d.user_id != ?
+  AND ct.tag_id IN (SELECT tag_id FROM user_tags)
+  AND d.id NOT IN (SELECT copied_from FROM decks WHERE user_id = ? AND copied_from IS NOT NULL)
+GROUP BY d.id
+ORDER BY overlap DESC, d.name
+LIMIT ?`, userID, userID, userID, limit)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []DeckSuggestion{}
+	for rows.Next() {
+		var sg DeckSuggestion
+		if err := rows.Scan(&sg.DeckID, &sg.Name, &sg.Description, &sg.Slug, &sg.SharedTags); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, sg)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// SimilarUser is another user who reviews cards in the same decks.
+type SimilarUser struct {
+	UserID           string `json:"userId"`
+	Username         string `json:"username"`
+	SharedDecksCount int    `json:"sharedDecksCount"`
+}
+
+// similarUserMinDecks is how many decks two users must both have reviewed
+// cards in to count as similar; similarUserLimit caps the result.
+const (
+	similarUserMinDecks = 3
+	similarUserLimit    = 10
+)
+
+// GET /users/{userId}/similar
+// Up to 10 users who have reviewed cards in at least 3 of the decks the
+// given user has reviewed cards in, most shared decks first.
+func (s *Server) similarUsersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`WITH reviewed AS (
+    SELECT DISTINCT rl.user_id, c.deck_id FROM review_log rl JOIN cards c ON c.id = rl.card_id
+)
+SELECT u.id, u.username, COUNT(*) AS shared
+FROM reviewed mine
+JOIN reviewed theirs ON theirs.deck_id = mine.deck_id AND theirs.user_id != mine.user_id
+JOIN users u ON u.id = theirs.user_id
+WHERE mine.user_id = ?
+GROUP BY u.id
+HAVING shared >= ?
+ORDER BY shared DESC, u.username
+LIMIT ?`, userID, similarUserMinDecks, similarUserLimit)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []SimilarUser{}
+	for rows.Next() {
+		var su SimilarUser
+		if err := rows.Scan(&su.UserID, &su.Username, &su.SharedDecksCount); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, su)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// DeckRecommendation is a public deck scored against what the user studies.
+type DeckRecommendation struct {
+	DeckID         string `json:"deckId"`
+	Name           string `json:"name"`
+	Description    string `json:"description,omitempty"`
+	Slug           string `json:"slug,omitempty"`
+	Score          int    `json:"score"`
+	SharedTags     int    `json:"sharedTags"`
+	SharedLanguage bool   `json:"sharedLanguage"`
+}
+
+// Recommendation weights: per tag shared with the user's decks, and for
+// sharing a translation language with them.
+const (
+	recommendTagPoints      = 3
+	recommendLanguagePoints = 2
+	recommendLimit          = 10
+)
+
+// GET /recommendations?userId=
+// Up to 10 public decks the user hasn't studied, scored 3 points per tag
+// shared with the decks they own or review plus 2 points if the deck has
+// translations in a language theirs do. Decks the user owns, has reviewed or
+// has copied are left out, as are decks scoring 0.
+func (s *Server) recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	if userID == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`WITH studied AS (
+    SELECT id AS deck_id FROM decks WHERE user_id = ?
+    UNION
+    SELECT c.deck_id FROM card_schedules cs JOIN cards c ON c.id = cs.card_id WHERE cs.user_id = ?
+),
+user_tags AS (
+    SELECT DISTINCT ct.tag_id FROM card_tags ct
+    JOIN cards c ON c.id = ct.card_id
+    WHERE c.deck_id IN (SELECT deck_id FROM studied)
+),
+user_langs AS (
+    SELECT DISTINCT t.lang_code FROM card_translations t
+    JOIN cards c ON c.id = t.card_id
+    WHERE c.deck_id IN (SELECT deck_id FROM studied)
+),
+scored AS (
+    SELECT d.id, d.name, COALESCE(d.description, '') AS description, COALESCE(d.slug, '') AS slug,
+        (SELECT COUNT(DISTINCT ct.tag_id) FROM card_tags ct JOIN cards c ON c.id = ct.card_id
+         WHERE c.deck_id = d.id AND ct.tag_id IN (SELECT tag_id FROM user_tags)) AS shared_tags,
+        EXISTS (SELECT 1 FROM card_translations t JOIN cards c ON c.id = t.card_id
+         WHERE c.deck_id = d.id AND t.lang_code IN (SELECT lang_code FROM user_langs)) AS shared_lang
+    FROM decks d
+    WHERE d.is_public = 1 AND d.archived = 0
+      AND d.id NOT IN (SELECT deck_id FROM studied)
+      AND d.id NOT IN (SELECT copied_from FROM decks WHERE user_id = ? AND copied_from IS NOT NULL)
+)
+SELECT id, name, description, slug, shared_tags, shared_lang, shared_tags * ? + shared_lang * ? AS score
+FROM scored
+WHERE score > 0
+ORDER BY score DESC, name, id
+LIMIT ?`, userID, userID, userID, recommendTagPoints, recommendLanguagePoints, recommendLimit)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []DeckRecommendation{}
+	for rows.Next() {
+		var rec DeckRecommendation
+		if err := rows.Scan(&rec.DeckID, &rec.Name, &rec.Description, &rec.Slug, &rec.SharedTags, &rec.SharedLanguage, &rec.Score); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		out = append(out, rec)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// embedTemplate renders the "Share to website" widget. The script fetches
+// GET /decks/{deckId} from data-api and renders a flip-card viewer into the div.
+var embedTemplate = template.Must(template.New("embed").Parse(`<div class="flashcards-embed" data-deck-id="{{.DeckID}}" data-api="{{.APIBase}}">
+  <style>
+    .flashcards-embed { font-family: sans-serif; max-width: 360px; perspective: 800px; }
+    .flashcards-embed .fc-card { position: relative; height: 200px; cursor: pointer; transition: transform .4s; transform-style: preserve-3d; }
+    .flashcards-embed .fc-card.flipped { transform: rotateY(180deg); }
+    .flashcards-embed .fc-face { position: absolute; inset: 0; display: flex; align-items: center; justify-content: center; padding: 16px; border: 1px solid #ccc; border-radius: 8px; background: #fff; backface-visibility: hidden; }
+    .flashcards-embed .fc-back { transform: rotateY(180deg); }
+  </style>
+  <noscript><a href="{{.APIBase}}/decks/{{.DeckID}}">{{.Name}}</a></noscript>
+</div>
+<script src="{{.ScriptURL}}" async></script>
+`))
+
+// frequencySampleSize caps the deck names returned by GET /public/cards/frequency.
+const frequencySampleSize = 5
+
+// GET /public/cards/frequency?front=
+// How many public decks have a card with this front, compared after trimming
+// and case-folding, plus a few of their names. Archived decks don't count.
+func (s *Server) cardFrequencyHandler(w http.ResponseWriter, r *http.Request) {
+	front := r.URL.Query().Get("front")
+	if strings.TrimSpace(front) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "front required"})
+		return
+	}
+	rows, err := s.db.Query(`SELECT d.name FROM decks d
+WHERE d.is_public = 1 AND d.archived = 0
+  AND EXISTS (SELECT 1 FROM cards c WHERE c.deck_id = d.id AND LOWER(TRIM(c.front)) = LOWER(TRIM(?)))
+ORDER BY d.name`, front)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	count := 0
+	sample := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		count++
+		if len(sample) < frequencySampleSize {
+			sample = append(sample, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"front":       strings.TrimSpace(front),
+		"deckCount":   count,
+		"sampleDecks": sample,
+	})
+}
+
+// GET /decks/{deckId}/embed
+// Only public decks can be embedded.
+func (s *Server) embedDeckHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "deckId")
+	var name string
+	var isPublic bool
+	if err := s.db.QueryRow(`SELECT name, is_public FROM decks WHERE id = ?`, id).Scan(&name, &isPublic); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if !isPublic {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotPublic, Status: http.StatusForbidden, Msg: "deck is not public"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_ = embedTemplate.Execute(w, struct {
+		DeckID, Name, APIBase, ScriptURL string
+	}{id, name, s.publicBaseURL(r), s.config.EmbedScriptURL})
+}
+
+// maxReportReason caps the length of a deck report's reason, in characters.
+const maxReportReason = 1000
+
+// POST /public/decks/{deckId}/report
+// body: { userId, reason }
+// Flags a public deck for moderation. Each user can report a deck once.
+func (s *Server) reportPublicDeckHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	var req struct {
+		UserID string `json:"userId"`
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if strings.TrimSpace(req.UserID) == "" || req.Reason == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId and reason required"})
+		return
+	}
+	if len([]rune(req.Reason)) > maxReportReason {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reason must be at most %d characters", maxReportReason)})
+		return
+	}
+	var isPublic bool
+	if err := s.db.QueryRow(`SELECT is_public FROM decks WHERE id = ?`, deckID).Scan(&isPublic); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if !isPublic {
+		setError(r.Context(), AppError{Code: ErrCodeDeckNotPublic, Status: http.StatusForbidden, Msg: "deck is not public"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	report := DeckReport{
+		ID:             genID(),
+		DeckID:         deckID,
+		ReporterUserID: req.UserID,
+		Reason:         req.Reason,
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+	_, err := s.db.Exec(`INSERT INTO deck_reports(id, deck_id, reporter_user_id, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		report.ID, report.DeckID, report.ReporterUserID, report.Reason, report.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			setError(r.Context(), AppError{Code: ErrCodeAlreadyReported, Status: http.StatusConflict, Msg: "you have already reported this deck"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.logger.Info("deck reported", "deckId", deckID, "userId", req.UserID)
+	s.respondJSON(w, http.StatusCreated, report)
+}
+
+/* ---------- Handlers: Cards ---------- */
+
+// maxCardImages caps the images attached to one card.
+const maxCardImages = 5
+
+// imageList stores Card.Images as a JSON array; no images is NULL.
+type imageList []string
+
+func (l *imageList) Scan(src interface{}) error {
+	*l = nil
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	}
+	return fmt.Errorf("cannot scan %T into imageList", src)
+}
+
+func (l imageList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal([]string(l))
+	return string(b), err
+}
+
+// validateCardImages checks the count and that each entry is an absolute
+// http(s) URL.
+func validateCardImages(images []string) error {
+	if len(images) > maxCardImages {
+		return fmt.Errorf("at most %d images per card", maxCardImages)
+	}
+	for i, raw := range images {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("images[%d] must be an http or https URL", i)
+		}
+	}
+	return nil
+}
+
+// POST /cards (bearer access token)
+// body: { deckId, front, back, hint, images }
+// The caller must own or edit the deck (same for PATCH/DELETE and
+// translations).
+func (s *Server) createCardHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DeckID string   `json:"deckId"`
+		Front  string   `json:"front"`
+		Back   string   `json:"back"`
+		Hint   string   `json:"hint"`
+		Images []string `json:"images"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.DeckID) == "" || strings.TrimSpace(req.Front) == "" || strings.TrimSpace(req.Back) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deckId, front and back required"})
+		return
+	}
+	if err := validateCardImages(req.Images); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	// ensure deck exists
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, req.DeckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidReference, Status: http.StatusUnprocessableEntity, Msg: "deck does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	actorID, ok := s.requireDeckEditor(r, req.DeckID)
+	if !ok {
+		return
+	}
+	id := genID()
+	_, err := s.db.Exec(`INSERT INTO cards(id, deck_id, front, back, hint, images) VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`, id, req.DeckID, req.Front, req.Back, req.Hint, imageList(req.Images))
+	if isCardLimitError(err) {
+		setError(r.Context(), AppError{Code: ErrCodeDeckCardLimit, Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("deck already has the maximum of %d cards", s.config.MaxCardsPerDeck)})
+		return
+	}
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	card := Card{ID: id, Front: req.Front, Back: req.Back, DeckID: req.DeckID, Hint: req.Hint, Images: req.Images}
+	s.recordAudit(req.DeckID, actorID, "card.create", map[string]string{"cardId": id})
+	s.respondJSON(w, http.StatusCreated, card)
+}
+
+// validCardFlags are the values a card's flag may take; no flag is NULL.
+var validCardFlags = map[string]bool{
+	"needs-review": true,
+	"confusing":    true,
+	"outdated":     true,
+}
+
+// PATCH /cards/{cardId}?diff=
+// With diff=true the response is a PatchDiff instead of the bare card.
+func (s *Server) patchCardHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	actorID, ok := s.requireCardEditor(r, id)
+	if !ok {
+		return
+	}
+	diff, err := parseDiffParam(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	var patch struct {
+		Front  *string   `json:"front"`
+		Back   *string   `json:"back"`
+		Flag   *string   `json:"flag"`
+		Hint   *string   `json:"hint"`
+		Images *[]string `json:"images"` // [] removes all images
+	}
+	if err := decodeJSON(r, &patch); err != nil && !errors.Is(err, errEmptyBody) {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if patch.Flag != nil && *patch.Flag != "" && !validCardFlags[*patch.Flag] {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "flag must be one of needs-review, confusing, outdated"})
+		return
+	}
+	if patch.Images != nil {
+		if err := validateCardImages(*patch.Images); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+			return
+		}
+	}
+	if patch.Front != nil && strings.TrimSpace(*patch.Front) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "front cannot be empty"})
+		return
+	}
+	if patch.Back != nil && strings.TrimSpace(*patch.Back) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "back cannot be empty"})
+		return
+	}
+	updates := map[string]interface{}{}
+	if patch.Front != nil {
+		updates["front"] = *patch.Front
+	}
+	if patch.Back != nil {
+		updates["back"] = *patch.Back
+	}
+	if patch.Flag != nil {
+		// An empty flag clears it.
+		updates["flag"] = nil
+		if *patch.Flag != "" {
+			updates["flag"] = *patch.Flag
+		}
+	}
+	if patch.Hint != nil {
+		// So does an empty hint.
+		updates["hint"] = nil
+		if *patch.Hint != "" {
+			updates["hint"] = *patch.Hint
+		}
+	}
+	if patch.Images != nil {
+		updates["images"] = imageList(*patch.Images)
+	}
+	if len(updates) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	var before Card
+	if diff {
+		err := s.db.QueryRow(`SELECT id, front, back, deck_id, COALESCE(flag, ''), COALESCE(hint, ''), images FROM cards WHERE id = ?`, id).
+			Scan(&before.ID, &before.Front, &before.Back, &before.DeckID, &before.Flag, &before.Hint, (*imageList)(&before.Images))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+				return
+			}
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+	}
+	setParts := []string{}
+	args := []interface{}{}
+	for k, v := range updates {
+		setParts = append(setParts, fmt.Sprintf("%s = ?", k))
+		args = append(args, v)
+	}
+	args = append(args, id)
+	query := fmt.Sprintf("UPDATE cards SET %s WHERE id = ?", strings.Join(setParts, ", "))
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rowsAff, _ := res.RowsAffected()
+	if rowsAff == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+		return
+	}
+	// return updated card
+	var c Card
+	err = s.db.QueryRow(`SELECT id, front, back, deck_id, COALESCE(flag, ''), COALESCE(hint, ''), images FROM cards WHERE id = ?`, id).
+		Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag, &c.Hint, (*imageList)(&c.Images))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	updates["cardId"] = id
+	s.recordAudit(c.DeckID, actorID, "card.update", updates)
+	if diff {
+		changed, err := changedFields(before, c)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "encode error"})
+			return
+		}
+		s.respondJSON(w, http.StatusOK, PatchDiff{Updated: changed, Resource: c})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, c)
+}
+
+// Two endpoints fetch cards by ID. POST /cards/batch-get (ids, up to 500)
+// answers a list in the order requested, for rendering. POST /cards/batch
+// (cardIds, up to 100) answers a map keyed by ID, for hydrating a study
+// queue the client keeps as IDs. Both go through readBatchCards.
+const (
+	maxBatchGetCards = 500
+	maxBatchCards    = 100
+)
+
+// readBatchCards decodes the ID list in the body's field, at most max of
+// them, and loads those cards in one query, each at most once and in no
+// particular order. With an access token each card carries the caller's
+// note. On failure it records the error and returns false.
+func (s *Server) readBatchCards(r *http.Request, field string, max int) ([]Card, []string, bool) {
+	userID, err := s.bearerUserID(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid or expired access token"})
+		return nil, nil, false
+	}
+	var body map[string]json.RawMessage
+	if err := decodeJSON(r, &body); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return nil, nil, false
+	}
+	var ids []string
+	if raw, ok := body[field]; ok {
+		if err := json.Unmarshal(raw, &ids); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: fmt.Sprintf("field '%s' must be an array of strings", field)})
+			return nil, nil, false
+		}
+	}
+	if len(ids) > max {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("at most %d %s per request", max, field)})
+		return nil, nil, false
+	}
+	cards, err := s.fetchCardsByIDs(ids)
+	if err == nil {
+		err = s.attachMyNotes(cards, userID)
+	}
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return nil, nil, false
+	}
+	return cards, ids, true
+}
+
+// POST /cards/batch-get
+// body: { ids }
+// Returns the cards in the order requested. Unknown IDs are left out; an ID
+// listed twice is returned twice.
+func (s *Server) batchGetCardsHandler(w http.ResponseWriter, r *http.Request) {
+	found, ids, ok := s.readBatchCards(r, "ids", maxBatchGetCards)
+	if !ok {
+		return
+	}
+	byID := make(map[string]Card, len(found))
+	for _, c := range found {
+		byID[c.ID] = c
+	}
+	cards := []Card{}
+	for _, id := range ids {
+		if c, ok := byID[id]; ok {
+			cards = append(cards, c)
+		}
+	}
+	s.respondJSON(w, http.StatusOK, cards)
+}
+
+// POST /cards/batch
+// body: { cardIds }
+// The cards keyed by ID. Unknown IDs are left out of the map.
+func (s *Server) batchCardsHandler(w http.ResponseWriter, r *http.Request) {
+	found, _, ok := s.readBatchCards(r, "cardIds", maxBatchCards)
+	if !ok {
+		return
+	}
+	cards := make(map[string]Card, len(found))
+	for _, c := range found {
+		cards[c.ID] = c
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{"cards": cards})
+}
+
+// fetchCardsByIDs loads the cards among ids in one query, each at most once
+// and in no particular order. Unknown IDs are skipped.
+func (s *Server) fetchCardsByIDs(ids []string) ([]Card, error) {
+	cards := []Card{}
+	if len(ids) == 0 {
+		return cards, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`SELECT id, front, back, deck_id, COALESCE(flag, ''), COALESCE(hint, ''), images FROM cards WHERE id IN (`+placeholders(len(args))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Card
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag, &c.Hint, (*imageList)(&c.Images)); err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
+
+// langCodePattern accepts BCP 47-ish tags like "ja", "pt-BR" or "zh-Hant".
+var langCodePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// GET /cards/{cardId}?lang=ja
+// With lang, front/back are replaced by their translations where one
+// exists; missing fields fall back to the card's default text. With an
+// access token the caller's private note is included as myNote.
+func (s *Server) getCardHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	userID, err := s.bearerUserID(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "invalid or expired access token"})
+		return
+	}
+	var c Card
+	err = s.db.QueryRow(`SELECT id, front, back, deck_id, COALESCE(flag, ''), COALESCE(hint, ''), images FROM cards WHERE id = ?`, id).
+		Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag, &c.Hint, (*imageList)(&c.Images))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		rows, err := s.db.Query(`SELECT field, content FROM card_translations WHERE card_id = ? AND lang_code = ?`, id, lang)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var field, content string
+			if err := rows.Scan(&field, &content); err != nil {
+				setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+				return
+			}
+			if field == "front" {
+				c.Front = content
+			} else {
+				c.Back = content
+			}
+		}
+		rows.Close()
+	}
+	cards := []Card{c}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if err := s.attachMyNotes(cards, userID); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, cards[0])
+}
+
+// attachMyNotes fills in MyNote for the given cards from userID's notes.
+// It does nothing when userID is empty.
+func (s *Server) attachMyNotes(cards []Card, userID string) error {
+	if userID == "" || len(cards) == 0 {
+		return nil
+	}
+	args := []interface{}{userID}
+	for _, c := range cards {
+		args = append(args, c.ID)
+	}
+	rows, err := s.db.Query(`SELECT card_id, note FROM card_notes WHERE user_id = ? AND card_id IN (`+placeholders(len(cards))+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	notes := map[string]string{}
+	for rows.Next() {
+		var cardID, note string
+		if err := rows.Scan(&cardID, &note); err != nil {
+			return err
+		}
+		notes[cardID] = note
+	}
+	for i := range cards {
+		cards[i].MyNote = notes[cards[i].ID]
+	}
+	return rows.Err()
+}
+
+// maxCardNoteLen caps a private card note, in characters.
+const maxCardNoteLen = 10000
+
+// CardNote is a user's private note on a card.
+type CardNote struct {
+	CardID    string `json:"cardId"`
+	Note      string `json:"note"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// requireBearerUser is bearerUserID for endpoints that need a signed-in
+// user. It records a 401 and returns false when there is none.
+func (s *Server) requireBearerUser(r *http.Request) (string, bool) {
+	userID, err := s.bearerUserID(r)
+	if err != nil || userID == "" {
+		setError(r.Context(), AppError{Code: ErrCodeUnauthorized, Status: http.StatusUnauthorized, Msg: "access token required"})
+		return "", false
+	}
+	return userID, true
+}
+
+// requireSelf admits only requests whose access token belongs to userID,
+// recording a 401 without a token and a 403 for anyone else's.
+func (s *Server) requireSelf(r *http.Request, userID string) bool {
+	caller, ok := s.requireBearerUser(r)
+	if !ok {
+		return false
+	}
+	if caller != userID {
+		setError(r.Context(), AppError{Code: ErrCodeForbidden, Status: http.StatusForbidden, Msg: "not allowed to act for this user"})
+		return false
+	}
+	return true
+}
+
+// requireSelfOrAdmin is requireSelf that also admits the admin token.
+func (s *Server) requireSelfOrAdmin(r *http.Request, userID string) bool {
+	return s.isAdminRequest(r) || s.requireSelf(r, userID)
+}
+
+// GET /cards/{cardId}/my-note (bearer access token)
+func (s *Server) getMyNoteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	n := CardNote{CardID: chi.URLParam(r, "cardId")}
+	err := s.db.QueryRow(`SELECT note, updated_at FROM card_notes WHERE card_id = ? AND user_id = ?`, n.CardID, userID).Scan(&n.Note, &n.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeNoteNotFound, Status: http.StatusNotFound, Msg: "no note on this card"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, n)
+}
+
+// PUT /cards/{cardId}/my-note (bearer access token)
+// body: { note }
+// Sets the caller's private note on any card; the card itself is not
+// changed. An empty note deletes it and responds 204.
+func (s *Server) putMyNoteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireBearerUser(r)
+	if !ok {
+		return
+	}
+	cardID := chi.URLParam(r, "cardId")
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len([]rune(req.Note)) > maxCardNoteLen {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("note must be at most %d characters", maxCardNoteLen)})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM cards WHERE id = ?`, cardID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if strings.TrimSpace(req.Note) == "" {
+		if _, err := s.db.Exec(`DELETE FROM card_notes WHERE card_id = ? AND user_id = ?`, cardID, userID); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	n := CardNote{CardID: cardID, Note: req.Note, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
+	_, err := s.db.Exec(`INSERT INTO card_notes(card_id, user_id, note, updated_at) VALUES (?, ?, ?, ?)
+ON CONFLICT(card_id, user_id) DO UPDATE SET note = excluded.note, updated_at = excluded.updated_at`, cardID, userID, n.Note, n.UpdatedAt)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, n)
+}
+
+// CardContext is a card with the IDs of the cards either side of it in its
+// deck, so a viewer can step through and preload without the whole list.
+type CardContext struct {
+	Card
+	PrevID *string `json:"prevId"`
+	NextID *string `json:"nextId"`
+}
+
+// GET /cards/{cardId}/context
+// Neighbours follow the deck's position order; prevId/nextId are null at
+// the ends.
+func (s *Server) cardContextHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	var c CardContext
+	var position sql.NullInt64
+	var prev, next sql.NullString
+	err := s.db.QueryRow(`SELECT id, front, back, deck_id, COALESCE(flag, ''), position, prev_id, next_id FROM (
+    SELECT c.*,
+        LAG(c.id) OVER deck_order AS prev_id,
+        LEAD(c.id) OVER deck_order AS next_id
+    FROM cards c
+    WHERE c.deck_id = (SELECT deck_id FROM cards WHERE id = ?)
+    WINDOW deck_order AS (ORDER BY c.position, c.rowid)
+) WHERE id = ?`, id, id).Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag, &position, &prev, &next)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if position.Valid {
+		p := int(position.Int64)
+		c.Position = &p
+	}
+	if prev.Valid {
+		c.PrevID = &prev.String
+	}
+	if next.Valid {
+		c.NextID = &next.String
+	}
+	cards := []Card{c.Card}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	c.Card = cards[0]
+	s.respondJSON(w, http.StatusOK, c)
+}
+
+// PUT /cards/{cardId}/translations/{lang}
+// Body: {"front": "...", "back": "..."}; either may be omitted. An empty
+// string removes that field's translation.
+func (s *Server) putCardTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	lang := chi.URLParam(r, "lang")
+	if !langCodePattern.MatchString(lang) {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid language code"})
+		return
+	}
+	actorID, ok := s.requireCardEditor(r, id)
+	if !ok {
+		return
+	}
+	var req struct {
+		Front *string `json:"front"`
+		Back  *string `json:"back"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.Front == nil && req.Back == nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "no fields to update"})
+		return
+	}
+	var deckID string
+	if err := s.db.QueryRow(`SELECT deck_id FROM cards WHERE id = ?`, id).Scan(&deckID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		for field, content := range map[string]*string{"front": req.Front, "back": req.Back} {
+			if content == nil {
+				continue
+			}
+			var err error
+			if strings.TrimSpace(*content) == "" {
+				_, err = tx.Exec(`DELETE FROM card_translations WHERE card_id = ? AND lang_code = ? AND field = ?`, id, lang, field)
+			} else {
+				_, err = tx.Exec(`INSERT INTO card_translations (card_id, lang_code, field, content) VALUES (?, ?, ?, ?)
+ON CONFLICT(card_id, lang_code, field) DO UPDATE SET content = excluded.content`, id, lang, field, *content)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.recordAudit(deckID, actorID, "card.translate", map[string]string{"cardId": id, "lang": lang})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /cards/{cardId}
+func (s *Server) deleteCardHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	actorID, ok := s.requireCardEditor(r, id)
+	if !ok {
+		return
+	}
+	var deckID string
+	if err := s.db.QueryRow(`SELECT deck_id FROM cards WHERE id = ?`, id).Scan(&deckID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	res, err := s.db.Exec(`DELETE FROM cards WHERE id = ?`, id)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+		return
+	}
+	s.recordAudit(deckID, actorID, "card.delete", map[string]string{"cardId": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /cards/{cardId}/check
+// body: { answer }
+// Compares the answer to the card back, ignoring surrounding whitespace and,
+// unless the deck is case sensitive, letter case.
+func (s *Server) checkAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "cardId")
+	var req struct {
+		Answer *string `json:"answer"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.Answer == nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "answer required"})
+		return
+	}
+	var back string
+	var caseSensitive bool
+	err := s.db.QueryRow(`SELECT c.back, d.case_sensitive FROM cards c JOIN decks d ON d.id = c.deck_id WHERE c.id = ?`, id).Scan(&back, &caseSensitive)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	answer, expected := strings.TrimSpace(*req.Answer), strings.TrimSpace(back)
+	correct := answer == expected
+	if !caseSensitive {
+		correct = strings.EqualFold(answer, expected)
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"correct":       correct,
+		"expected":      back,
+		"caseSensitive": caseSensitive,
+	})
+}
+
+// DuplicateGroup is a set of a user's cards with the same front and back.
+type DuplicateGroup struct {
+	Front string          `json:"front"`
+	Back  string          `json:"back"`
+	Cards []DuplicateCard `json:"cards"`
+}
+
+type DuplicateCard struct {
+	CardID   string `json:"cardId"`
+	DeckID   string `json:"deckId"`
+	DeckName string `json:"deckName"`
+}
+
+// GET /users/{userId}/duplicates
+// Groups cards across all of the user's decks whose front and back match
+// after trimming and case-folding.
+func (s *Server) duplicateCardsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	rows, err := s.db.Query(`WITH normalized AS (
+    SELECT c.id, c.deck_id, d.name AS deck_name, c.front, c.back,
+           LOWER(TRIM(c.front)) AS nf, LOWER(TRIM(c.back)) AS nb
+    FROM cards c JOIN decks d ON d.id = c.deck_id
+    WHERE d.user_id = ?
+), dupes AS (
+    SELECT nf, nb FROM normalized GROUP BY nf, nb HAVING COUNT(*) > 1
+)
+SELECT n.id, n.deck_id, n.deck_name, n.front, n.back, n.nf, n.nb
+FROM normalized n JOIN dupes USING (nf, nb)
+ORDER BY n.nf, n.nb, n.deck_name, n.id`, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	groups := []DuplicateGroup{}
+	var lastKey [2]string
+	for rows.Next() {
+		var dc DuplicateCard
+		var front, back, nf, nb string
+		if err := rows.Scan(&dc.CardID, &dc.DeckID, &dc.DeckName, &front, &back, &nf, &nb); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if key := [2]string{nf, nb}; len(groups) == 0 || key != lastKey {
+			groups = append(groups, DuplicateGroup{Front: front, Back: back})
+			lastKey = key
+		}
+		g := &groups[len(groups)-1]
+		g.Cards = append(g.Cards, dc)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, groups)
+}
+
+/* ---------- Handlers: Reviews ---------- */
+
+// Schedule is a user's SM-2 state for one card. Interval is in days.
+type Schedule struct {
+	CardID         string  `json:"cardId"`
+	UserID         string  `json:"userId"`
+	EaseFactor     float64 `json:"easeFactor"`
+	Interval       int     `json:"interval"`
+	Repetitions    int     `json:"repetitions"`
+	DueAt          string  `json:"dueAt"`
+	LastReviewedAt string  `json:"lastReviewedAt,omitempty"`
+	// Locked schedules keep their due date when graded; see pinDueHandler.
+	Locked bool `json:"locked"`
+}
+
+// newSchedule is the state of a card the user has never reviewed.
+func newSchedule(cardID, userID string, now time.Time) Schedule {
+	return Schedule{CardID: cardID, UserID: userID, EaseFactor: 2.5, DueAt: now.UTC().Format(time.RFC3339)}
+}
+
+// sm2 applies one review of the given quality (0-5) at time now.
+func sm2(s Schedule, quality int, now time.Time) Schedule {
+	if quality < 3 {
+		s.Repetitions = 0
+		s.Interval = 1
+	} else {
+		s.Repetitions++
+		switch s.Repetitions {
+		case 1:
+			s.Interval = 1
+		case 2:
+			s.Interval = 6
+		default:
+			s.Interval = int(math.Round(float64(s.Interval) * s.EaseFactor))
+		}
+	}
+	q := float64(5 - quality)
+	s.EaseFactor = math.Round((s.EaseFactor+0.1-q*(0.08+q*0.02))*100) / 100
+	if s.EaseFactor < 1.3 {
+		s.EaseFactor = 1.3
+	}
+	now = now.UTC()
+	s.DueAt = now.AddDate(0, 0, s.Interval).Format(time.RFC3339)
+	s.LastReviewedAt = now.Format(time.RFC3339)
+	return s
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// fetchSchedule returns the stored schedule, or a fresh one when the user
+// has never reviewed the card.
+func fetchSchedule(q queryRower, cardID, userID string, now time.Time) (Schedule, error) {
+	s := Schedule{CardID: cardID, UserID: userID}
+	var last sql.NullString
+	err := q.QueryRow(`SELECT ease_factor, interval_days, repetitions, due_at, last_reviewed_at, locked
+FROM card_schedules WHERE card_id = ? AND user_id = ?`, cardID, userID).Scan(&s.EaseFactor, &s.Interval, &s.Repetitions, &s.DueAt, &last, &s.Locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newSchedule(cardID, userID, now), nil
+	}
+	if last.Valid {
+		s.LastReviewedAt = last.String
+	}
+	return s, err
+}
+
+// POST /cards/{cardId}/review?affectSchedule=false
+// body: { userId, quality: 0-5, durationMs? }
+// With affectSchedule=false (cram mode) nothing is stored and the current
+// schedule is returned unchanged.
+func (s *Server) reviewCardHandler(w http.ResponseWriter, r *http.Request) {
+	cardID := chi.URLParam(r, "cardId")
+	affectSchedule := true
+	if v := r.URL.Query().Get("affectSchedule"); v != "" {
+		var err error
+		if affectSchedule, err = strconv.ParseBool(v); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "affectSchedule must be true or false"})
+			return
+		}
+	}
+	var req struct {
+		UserID     string `json:"userId"`
+		Quality    *int   `json:"quality"`
+		DurationMs *int64 `json:"durationMs"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.UserID) == "" || req.Quality == nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId and quality required"})
+		return
+	}
+	if *req.Quality < 0 || *req.Quality > 5 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "quality must be between 0 and 5"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM cards WHERE id = ?`, cardID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	if !affectSchedule {
+		sched, err := fetchSchedule(s.db, cardID, req.UserID, time.Now())
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		s.respondJSON(w, http.StatusOK, sched)
+		return
+	}
+	var after Schedule
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		after, err = applyReview(tx, cardID, req.UserID, *req.Quality, req.DurationMs, time.Now())
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, after)
+}
+
+// applyReview runs SM-2 for one review taken at time at, saves the new
+// schedule and appends the review log entry. The caller owns the transaction.
+// The entry's due_before is NULL when the user had no schedule for the card,
+// so undoing the review knows to make the card new again.
+func applyReview(tx *sql.Tx, cardID, userID string, quality int, durationMs *int64, at time.Time) (Schedule, error) {
+	at = at.UTC()
+	before, err := fetchSchedule(tx, cardID, userID, at)
+	if err != nil {
+		return Schedule{}, err
+	}
+	var scheduled bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM card_schedules WHERE card_id = ? AND user_id = ?)`, cardID, userID).Scan(&scheduled); err != nil {
+		return Schedule{}, err
+	}
+	dueBefore := sql.NullString{String: before.DueAt, Valid: scheduled}
+	after := sm2(before, quality, at)
+	if before.Locked {
+		// Pinned by a teacher: grading still updates the SM-2 state, but the
+		// card stays due when it was pinned.
+		after.DueAt = before.DueAt
+	}
+
+	_, err = tx.Exec(`INSERT INTO card_schedules(card_id, user_id, ease_factor, interval_days, repetitions, due_at, last_reviewed_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(card_id, user_id) DO UPDATE SET ease_factor = excluded.ease_factor, interval_days = excluded.interval_days,
+    repetitions = excluded.repetitions, due_at = excluded.due_at, last_reviewed_at = excluded.last_reviewed_at`,
+		cardID, userID, after.EaseFactor, after.Interval, after.Repetitions, after.DueAt, after.LastReviewedAt)
+	if err != nil {
+		return Schedule{}, err
+	}
+	_, err = tx.Exec(`INSERT INTO review_log(id, card_id, user_id, quality, reviewed_at, duration_ms,
+    interval_before, ease_before, repetitions_before, due_before, interval_after, ease_after)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		genID(), cardID, userID, quality, after.LastReviewedAt, durationMs,
+		before.Interval, before.EaseFactor, before.Repetitions, dueBefore, after.Interval, after.EaseFactor)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return after, nil
+}
+
+// maxBulkReviews caps the entries accepted by POST /study/bulk-review.
+const maxBulkReviews = 100
+
+// POST /study/bulk-review
+// body: { offlineToken?, reviews: [{ cardId, userId, quality, reviewedAt?, timeSpentMs? }] }
+// Replays reviews recorded offline, oldest first, in one transaction: either
+// all are applied or none are. reviewedAt defaults to now. With the token
+// the reviews were studied from, cards edited since it was issued are
+// listed in conflicts (their reviews are still applied).
+func (s *Server) bulkReviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OfflineToken string `json:"offlineToken"`
+		Reviews      []struct {
+			CardID      string `json:"cardId"`
+			UserID      string `json:"userId"`
+			Quality     *int   `json:"quality"`
+			ReviewedAt  string `json:"reviewedAt"`
+			TimeSpentMs *int64 `json:"timeSpentMs"`
+		} `json:"reviews"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if len(req.Reviews) == 0 || len(req.Reviews) > maxBulkReviews {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews must contain 1 to %d entries", maxBulkReviews)})
+		return
+	}
+	now := time.Now().UTC()
+	times := make([]time.Time, len(req.Reviews))
+	for i, rv := range req.Reviews {
+		if strings.TrimSpace(rv.CardID) == "" || strings.TrimSpace(rv.UserID) == "" || rv.Quality == nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews[%d]: cardId, userId and quality required", i)})
+			return
+		}
+		if *rv.Quality < 0 || *rv.Quality > 5 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews[%d]: quality must be between 0 and 5", i)})
+			return
+		}
+		times[i] = now
+		if rv.ReviewedAt != "" {
+			t, err := time.Parse(time.RFC3339, rv.ReviewedAt)
+			if err != nil || t.After(now.Add(time.Minute)) {
+				setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews[%d]: reviewedAt must be an RFC 3339 time not in the future", i)})
+				return
+			}
+			times[i] = t
+		}
+	}
+	var issuedAt int64
+	if req.OfflineToken != "" {
+		var claims OfflineClaims
+		if err := verifyJWT(req.OfflineToken, s.config.StudyTokenSecret, &claims); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "offlineToken: " + err.Error()})
+			return
+		}
+		issuedAt = claims.IssuedAt
+	}
+	order := make([]int, len(req.Reviews))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return times[order[a]].Before(times[order[b]]) })
+
+	results := make([]Schedule, len(req.Reviews))
+	conflicts := []string{}
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		for _, i := range order {
+			rv := req.Reviews[i]
+			var updatedAt sql.NullString
+			if err := tx.QueryRow(`SELECT updated_at FROM cards WHERE id = ?`, rv.CardID).Scan(&updatedAt); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return AppError{Code: ErrCodeCardNotFound, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews[%d]: card not found", i)}
+				}
+				return err
+			}
+			if issuedAt != 0 && updatedAt.Valid && !slices.Contains(conflicts, rv.CardID) {
+				if t, err := time.Parse(time.RFC3339, updatedAt.String); err == nil && t.Unix() > issuedAt {
+					conflicts = append(conflicts, rv.CardID)
+				}
+			}
+			var tmp string
+			if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, rv.UserID).Scan(&tmp); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: fmt.Sprintf("reviews[%d]: user does not exist", i)}
+				}
+				return err
+			}
+			var err error
+			results[i], err = applyReview(tx, rv.CardID, rv.UserID, *rv.Quality, rv.TimeSpentMs, times[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{"results": results, "conflicts": conflicts})
+}
+
+// reviewUndoWindow is how long after a review it can still be undone.
+const reviewUndoWindow = 5 * time.Minute
+
+// GET /cards/{cardId}/schedule?userId=&reviews=5
+// Simulates the next reviews, each graded 4 and taken on its due date (or
+// now if the card is already due), and lists the resulting due dates.
+// Nothing is stored.
+func (s *Server) schedulePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	cardID := chi.URLParam(r, "cardId")
+	q := r.URL.Query()
+	userID := q.Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	reviews := 5
+	if v := q.Get("reviews"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 50 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "reviews must be between 1 and 50"})
+			return
+		}
+		reviews = n
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM cards WHERE id = ?`, cardID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	now := time.Now().UTC()
+	sched, err := fetchSchedule(s.db, cardID, userID, now)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	at := now
+	if due, err := time.Parse(time.RFC3339, sched.DueAt); err == nil && due.After(now) {
+		at = due
+	}
+	dates := make([]string, 0, reviews)
+	for i := 0; i < reviews; i++ {
+		sched = sm2(sched, 4, at)
+		at, _ = time.Parse(time.RFC3339, sched.DueAt)
+		dates = append(dates, at.Format("2006-01-02"))
+	}
+	s.respondJSON(w, http.StatusOK, map[string][]string{"scheduledDates": dates})
+}
+
+// SimulationDay is one day of a deck simulation. Reviews counts cards
+// already seen that came due; NewCards were studied for the first time.
+type SimulationDay struct {
+	Day      int    `json:"day"`
+	Date     string `json:"date"`
+	NewCards int    `json:"newCards"`
+	Reviews  int    `json:"reviews"`
+}
+
+// DeckSimulation is the projected study load of starting a deck from scratch.
+type DeckSimulation struct {
+	DeckID       string          `json:"deckId"`
+	CardCount    int             `json:"cardCount"`
+	NewPerDay    int             `json:"newPerDay"`
+	SuccessRate  float64         `json:"successRate"`
+	TotalReviews int             `json:"totalReviews"`
+	Series       []SimulationDay `json:"series"`
+}
+
+// simulateStudy runs SM-2 over cardCount unseen cards for days days,
+// introducing up to newPerDay of them each day and reviewing every card on
+// its due date. Reviews pass (quality 4) or fail (quality 2) so that the
+// share of passes tracks successRate exactly; there is no randomness, so
+// the same input always gives the same series.
+func simulateStudy(cardCount, newPerDay, days int, successRate float64, start time.Time) []SimulationDay {
+	due := map[int][]Schedule{} // day index -> cards due that day
+	introduced := 0
+	credit := 0.0
+	series := make([]SimulationDay, 0, days)
+	for d := 0; d < days; d++ {
+		at := start.AddDate(0, 0, d)
+		day := SimulationDay{Day: d + 1, Date: at.Format("2006-01-02")}
+		cards := due[d]
+		delete(due, d)
+		day.Reviews = len(cards)
+		for n := 0; n < newPerDay && introduced < cardCount; n++ {
+			cards = append(cards, Schedule{EaseFactor: 2.5})
+			introduced++
+			day.NewCards++
+		}
+		for _, c := range cards {
+			quality := 2
+			if credit += successRate; credit >= 1 {
+				credit--
+				quality = 4
+			}
+			c = sm2(c, quality, at)
+			due[d+c.Interval] = append(due[d+c.Interval], c)
+		}
+		series = append(series, day)
+	}
+	return series
+}
+
+// POST /decks/{deckId}/simulate
+// body: { newPerDay, days, successRate }
+// Projects the daily review load of studying the deck from scratch, for
+// planning before starting it. successRate defaults to 0.9. Nothing is
+// stored.
+func (s *Server) simulateDeckHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	var req struct {
+		NewPerDay   int      `json:"newPerDay"`
+		Days        int      `json:"days"`
+		SuccessRate *float64 `json:"successRate"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if req.NewPerDay < 1 || req.NewPerDay > 1000 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "newPerDay must be between 1 and 1000"})
+		return
+	}
+	if req.Days < 1 || req.Days > 365 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "days must be between 1 and 365"})
+		return
+	}
+	successRate := 0.9
+	if req.SuccessRate != nil {
+		successRate = *req.SuccessRate
+		if successRate < 0 || successRate > 1 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "successRate must be between 0 and 1"})
+			return
+		}
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var cardCount int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM cards WHERE deck_id = ?`, deckID).Scan(&cardCount); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	sim := DeckSimulation{
+		DeckID:      deckID,
+		CardCount:   cardCount,
+		NewPerDay:   req.NewPerDay,
+		SuccessRate: successRate,
+		Series:      simulateStudy(cardCount, req.NewPerDay, req.Days, successRate, time.Now().UTC()),
+	}
+	for _, d := range sim.Series {
+		sim.TotalReviews += d.Reviews
+	}
+	s.respondJSON(w, http.StatusOK, sim)
+}
+
+// gradeName labels an SM-2 quality the way the difficulty filter does.
+func gradeName(quality int) string {
+	switch {
+	case quality < 3:
+		return "again"
+	case quality == 3:
+		return "hard"
+	case quality == 4:
+		return "good"
+	default:
+		return "easy"
+	}
+}
+
+// GradePreview is what reviewing a card now with Quality would lead to.
+type GradePreview struct {
+	Quality  int    `json:"quality"`
+	Grade    string `json:"grade"`
+	Interval int    `json:"interval"` // days
+	DueAt    string `json:"dueAt"`
+}
+
+// GET /cards/{cardId}/review-preview?userId=
+// Projects the next interval for each quality 0-5 from the user's current
+// schedule, for labelling answer buttons. Nothing is stored.
+func (s *Server) reviewPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	cardID := chi.URLParam(r, "cardId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM cards WHERE id = ?`, cardID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	now := time.Now().UTC()
+	sched, err := fetchSchedule(s.db, cardID, userID, now)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	out := make([]GradePreview, 0, 6)
+	for q := 0; q <= 5; q++ {
+		next := sm2(sched, q, now)
+		out = append(out, GradePreview{Quality: q, Grade: gradeName(q), Interval: next.Interval, DueAt: next.DueAt})
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// POST /cards/{cardId}/pin-due
+// body: { userId, dueAt, lock? }
+// Teacher override: makes the card due for the user at dueAt. With lock,
+// reviews keep that due date until the card is pinned again without lock.
+func (s *Server) pinDueHandler(w http.ResponseWriter, r *http.Request) {
+	cardID := chi.URLParam(r, "cardId")
+	var req struct {
+		UserID string `json:"userId"`
+		DueAt  string `json:"dueAt"`
+		Lock   bool   `json:"lock"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.UserID) == "" || req.DueAt == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId and dueAt required"})
+		return
+	}
+	due, err := time.Parse(time.RFC3339, req.DueAt)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "dueAt must be an RFC 3339 time"})
+		return
+	}
+	var sched Schedule
+	err = s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var tmp string
+		if err := tx.QueryRow(`SELECT id FROM cards WHERE id = ?`, cardID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeCardNotFound, Status: http.StatusNotFound, Msg: "card not found"}
+			}
+			return err
+		}
+		if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeUserNotFound, Status: http.StatusBadRequest, Msg: "user does not exist"}
+			}
+			return err
+		}
+		var err error
+		if sched, err = fetchSchedule(tx, cardID, req.UserID, time.Now()); err != nil {
+			return err
+		}
+		sched.DueAt = due.UTC().Format(time.RFC3339)
+		sched.Locked = req.Lock
+		_, err = tx.Exec(`INSERT INTO card_schedules(card_id, user_id, ease_factor, interval_days, repetitions, due_at, locked)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(card_id, user_id) DO UPDATE SET due_at = excluded.due_at, locked = excluded.locked`,
+			cardID, req.UserID, sched.EaseFactor, sched.Interval, sched.Repetitions, sched.DueAt, sched.Locked)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, sched)
+}
+
+// POST /cards/{cardId}/review/undo
+// body: { userId }
+// Reverts the user's most recent review of the card if it happened within
+// reviewUndoWindow, restoring the schedule from the review log. A schedule
+// that existed before the review, such as one set by pin-due, is restored
+// with its locked flag; otherwise the card becomes new again.
+func (s *Server) undoReviewHandler(w http.ResponseWriter, r *http.Request) {
+	cardID := chi.URLParam(r, "cardId")
+	var req struct {
+		UserID string `json:"userId"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.UserID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+
+	restored := Schedule{CardID: cardID, UserID: req.UserID}
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var logID, reviewedAt string
+		var dueBefore sql.NullString
+		err := tx.QueryRow(`SELECT id, reviewed_at, interval_before, ease_before, repetitions_before, due_before
+FROM review_log WHERE card_id = ? AND user_id = ?
+ORDER BY reviewed_at DESC, rowid DESC LIMIT 1`, cardID, req.UserID).
+			Scan(&logID, &reviewedAt, &restored.Interval, &restored.EaseFactor, &restored.Repetitions, &dueBefore)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return AppError{Code: ErrCodeReviewNotFound, Status: http.StatusNotFound, Msg: "no review to undo"}
+			}
+			return err
+		}
+		t, err := time.Parse(time.RFC3339, reviewedAt)
+		if err != nil || time.Since(t) > reviewUndoWindow {
+			return AppError{Code: ErrCodeUndoWindowExpired, Status: http.StatusConflict, Msg: "review can no longer be undone"}
+		}
+		if _, err := tx.Exec(`DELETE FROM review_log WHERE id = ?`, logID); err != nil {
+			return err
+		}
+
+		if !dueBefore.Valid {
+			// The user had no schedule before this review: the card is new again.
+			if _, err := tx.Exec(`DELETE FROM card_schedules WHERE card_id = ? AND user_id = ?`, cardID, req.UserID); err != nil {
+				return err
+			}
+			restored = newSchedule(cardID, req.UserID, time.Now())
+			return nil
+		}
+
+		// The review before the undone one (if any) is the new last review.
+		var prevReviewedAt sql.NullString
+		if err := tx.QueryRow(`SELECT MAX(reviewed_at) FROM review_log WHERE card_id = ? AND user_id = ?`, cardID, req.UserID).Scan(&prevReviewedAt); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT locked FROM card_schedules WHERE card_id = ? AND user_id = ?`, cardID, req.UserID).Scan(&restored.Locked); err != nil {
+			return err
+		}
+		restored.DueAt = dueBefore.String
+		restored.LastReviewedAt = prevReviewedAt.String
+		_, err = tx.Exec(`UPDATE card_schedules SET ease_factor = ?, interval_days = ?, repetitions = ?, due_at = ?, last_reviewed_at = ?
+WHERE card_id = ? AND user_id = ?`, restored.EaseFactor, restored.Interval, restored.Repetitions, restored.DueAt, prevReviewedAt, cardID, req.UserID)
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, restored)
+}
+
+// userLocation picks the time zone for a user's day boundaries: ?tz= when
+// given, else the user's saved timezone, else UTC. On a bad ?tz= it records
+// the error with setError and returns false.
+func (s *Server) userLocation(r *http.Request, userID string) (*time.Location, bool) {
+	if v := r.URL.Query().Get("tz"); v != "" {
+		loc, err := parseTZOffset(v)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+			return nil, false
+		}
+		return loc, true
+	}
+	var tz sql.NullString
+	err := s.db.QueryRow(`SELECT timezone FROM users WHERE id = ?`, userID).Scan(&tz)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return nil, false
+	}
+	if !tz.Valid || tz.String == "" {
+		return time.UTC, true
+	}
+	loc, err := time.LoadLocation(tz.String)
+	if err != nil {
+		s.logger.Warn("stored timezone no longer loads", "userId", userID, "timezone", tz.String)
+		return time.UTC, true
+	}
+	return loc, true
+}
+
+// parseTZOffset parses a UTC offset such as "+02:00", "-0530" or "Z", or an
+// IANA zone name like "Europe/Berlin".
+func parseTZOffset(v string) (*time.Location, error) {
+	// An unescaped '+' in a query string arrives as a space.
+	if strings.HasPrefix(v, " ") {
+		v = "+" + strings.TrimSpace(v)
+	}
+	if v == "" || v == "Z" || v == "UTC" {
+		return time.UTC, nil
+	}
+	for _, layout := range []string{"-07:00", "-0700", "-07"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			_, offset := t.Zone()
+			return time.FixedZone(v, offset), nil
+		}
+	}
+	if strings.Contains(v, "/") {
+		if loc, err := time.LoadLocation(v); err == nil {
+			return loc, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid tz offset %q", v)
+}
+
+type CalendarDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// CalendarMonthDay is one day of the monthly calendar view.
+type CalendarMonthDay struct {
+	Date        string `json:"date"`
+	ReviewCount int    `json:"reviewCount"`
+	NewCards    int    `json:"newCards"` // cards reviewed for the first time
+}
+
+// GET /users/{userId}/calendar?year=YYYY&month=M&tz=+02:00
+// Review counts for every day of the year, zero days included. With month,
+// only that month is returned, as CalendarMonthDay entries. Days follow tz,
+// or the user's saved timezone when tz is omitted.
+func (s *Server) studyCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
+	}
+	var err error
+	year := time.Now().In(loc).Year()
+	if v := r.URL.Query().Get("year"); v != "" {
+		year, err = strconv.Atoi(v)
+		if err != nil || year < 1970 || year > 9999 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "invalid year"})
+			return
+		}
+	}
+	month := 0
+	if v := r.URL.Query().Get("month"); v != "" {
+		month, err = strconv.Atoi(v)
+		if err != nil || month < 1 || month > 12 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "month must be between 1 and 12"})
+			return
+		}
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+	end := start.AddDate(1, 0, 0)
+	if month != 0 {
+		start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
+	}
+	rows, err := s.db.Query(`SELECT rl.reviewed_at, rl.rowid = (
+    SELECT first.rowid FROM review_log first
+    WHERE first.card_id = rl.card_id AND first.user_id = rl.user_id
+    ORDER BY first.reviewed_at, first.rowid LIMIT 1
+)
+FROM review_log rl WHERE rl.user_id = ? AND rl.reviewed_at >= ? AND rl.reviewed_at < ?`,
+		userID, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	newCards := map[string]int{}
+	for rows.Next() {
+		var at string
+		var first bool
+		if err := rows.Scan(&at, &first); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			continue
+		}
+		key := t.In(loc).Format("2006-01-02")
+		counts[key]++
+		if first {
+			newCards[key]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	if month != 0 {
+		out := []CalendarMonthDay{}
+		for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+			key := d.Format("2006-01-02")
+			out = append(out, CalendarMonthDay{Date: key, ReviewCount: counts[key], NewCards: newCards[key]})
+		}
+		s.respondJSON(w, http.StatusOK, out)
+		return
+	}
+	out := []CalendarDay{}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		out = append(out, CalendarDay{Date: key, Count: counts[key]})
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// maxStreakShields caps how many streak shields a user can hold.
+const maxStreakShields = 2
+
+// streakShieldMilestone is the streak length (and multiples) that earns a shield.
+const streakShieldMilestone = 7
+
+type Streak struct {
+	Current      int  `json:"currentStreak"`
+	StudiedToday bool `json:"studiedToday"`
+	Shields      int  `json:"shields"`
+}
+
+// computeStreak counts consecutive study days ending today (or yesterday,
+// since today isn't over yet) in loc. A gap is bridged when the user holds
+// enough shields to cover every missed day in it: those days are recorded
+// in streak_shield_days so later calls don't spend shields on them again.
+// Shielded days keep the streak alive but don't add to it. Each time the
+// streak reaches a multiple of streakShieldMilestone a shield is awarded,
+// once per milestone day.
+func computeStreak(tx *sql.Tx, userID string, loc *time.Location, now time.Time) (Streak, error) {
+	var st Streak
+	var awardedOn sql.NullString
+	if err := tx.QueryRow(`SELECT streak_shields, streak_shield_awarded_on FROM users WHERE id = ?`, userID).Scan(&st.Shields, &awardedOn); err != nil {
+		return st, err
+	}
+	studied := map[string]bool{}
+	rows, err := tx.Query(`SELECT reviewed_at FROM review_log WHERE user_id = ?`, userID)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var at string
+		if err := rows.Scan(&at); err != nil {
+			rows.Close()
+			return st, err
+		}
+		if t, err := time.Parse(time.RFC3339, at); err == nil {
+			studied[t.In(loc).Format("2006-01-02")] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return st, err
+	}
+	shielded := map[string]bool{}
+	rows, err = tx.Query(`SELECT day FROM streak_shield_days WHERE user_id = ?`, userID)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return st, err
+		}
+		shielded[day] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return st, err
+	}
+
+	key := func(d time.Time) string { return d.Format("2006-01-02") }
+	today := now.In(loc)
+	cursor := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, loc)
+	st.StudiedToday = studied[key(cursor)]
+	if !st.StudiedToday && !shielded[key(cursor)] {
+		cursor = cursor.AddDate(0, 0, -1)
+	}
+	lastStudied := ""
+	for {
+		k := key(cursor)
+		if studied[k] {
+			if lastStudied == "" {
+				lastStudied = k
+			}
+			st.Current++
+			cursor = cursor.AddDate(0, 0, -1)
+			continue
+		}
+		if shielded[k] {
+			cursor = cursor.AddDate(0, 0, -1)
+			continue
+		}
+		// A gap: bridge it only if it ends at an earlier study day and the
+		// shields cover all of it.
+		var gap []string
+		c := cursor
+		for !studied[key(c)] && !shielded[key(c)] && len(gap) <= st.Shields {
+			gap = append(gap, key(c))
+			c = c.AddDate(0, 0, -1)
+		}
+		if st.Current == 0 || len(gap) > st.Shields {
+			break
+		}
+		for _, day := range gap {
+			if _, err := tx.Exec(`INSERT INTO streak_shield_days (user_id, day) VALUES (?, ?)`, userID, day); err != nil {
+				return st, err
+			}
+			shielded[day] = true
+		}
+		st.Shields -= len(gap)
+		cursor = c
+	}
+
+	if st.Current > 0 && st.Current%streakShieldMilestone == 0 && awardedOn.String != lastStudied {
+		st.Shields = min(st.Shields+1, maxStreakShields)
+		awardedOn = sql.NullString{String: lastStudied, Valid: true}
+	}
+	_, err = tx.Exec(`UPDATE users SET streak_shields = ?, streak_shield_awarded_on = ? WHERE id = ?`, st.Shields, awardedOn, userID)
+	return st, err
+}
+
+// GET /users/{userId}/streak?tz=+02:00
+// Days follow tz, or the user's saved timezone when tz is omitted.
+func (s *Server) streakHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
+	}
+	var st Streak
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		st, err = computeStreak(tx, userID, loc, time.Now())
+		if errors.Is(err, sql.ErrNoRows) {
+			return AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"}
+		}
+		return err
+	})
+	if err != nil {
+		setTxError(r.Context(), err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, st)
+}
+
+// POST /users/{userId}/streak-shield
+// Awards one shield, up to maxStreakShields.
+func (s *Server) awardStreakShieldHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	var shields int
+	err := s.db.QueryRow(`UPDATE users SET streak_shields = MIN(streak_shields + 1, ?) WHERE id = ? RETURNING streak_shields`,
+		maxStreakShields, userID).Scan(&shields)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, map[string]int{"shields": shields})
+}
+
+// GET /decks/{deckId}/session-estimate?userId=
+// Due cards (including never-reviewed ones) times the user's average review
+// time, or Config.SecondsPerCard when they have no timed reviews yet.
+func (s *Server) sessionEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var due int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM cards c
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE c.deck_id = ? AND (cs.card_id IS NULL OR cs.due_at <= ?)`, userID, deckID, time.Now().UTC().Format(time.RFC3339)).Scan(&due)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var avgMs sql.NullFloat64
+	if err := s.db.QueryRow(`SELECT AVG(duration_ms) FROM review_log WHERE user_id = ? AND duration_ms IS NOT NULL`, userID).Scan(&avgMs); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	perCard := float64(s.config.SecondsPerCard)
+	if avgMs.Valid {
+		perCard = avgMs.Float64 / 1000
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"deckId":           deckID,
+		"userId":           userID,
+		"dueCards":         due,
+		"secondsPerCard":   math.Round(perCard*10) / 10,
+		"estimatedSeconds": int(math.Round(float64(due) * perCard)),
+		"fromHistory":      avgMs.Valid,
+	})
+}
+
+// StudyCard is the card served by GET /study/next. HintDelaySeconds, set
+// when the card has a hint, is how long the UI waits before showing it.
+type StudyCard struct {
+	Card
+	HintDelaySeconds *int `json:"hintDelaySeconds,omitempty"`
+}
+
+// GET /study/next?userId=&deckId=|collectionId=
+// One card to study: the most overdue card, or a random never-reviewed one
+// when nothing is due. Without deckId, all of the user's unarchived decks are
+// considered. With collectionId, the collection's decks are worked through in
+// order: cards from an earlier deck come before any from a later one. Due
+// cards stop once the user's reviewLimit is reached for the
+// day and new cards once newCardsPerDay is. 204 when there's nothing to
+// study.
+func (s *Server) nextStudyCardHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID := q.Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	scope := "d.user_id = ? AND d.archived = 0"
+	scopeArg := userID
+	deckOrder := ""
+	var orderArgs []interface{}
+	if q.Get("deckId") != "" && q.Get("collectionId") != "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deckId and collectionId are mutually exclusive"})
+		return
+	}
+	if collectionID := q.Get("collectionId"); collectionID != "" {
+		var tmp string
+		if err := s.db.QueryRow(`SELECT id FROM collections WHERE id = ?`, collectionID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				setError(r.Context(), AppError{Code: ErrCodeCollectionNotFound, Status: http.StatusNotFound, Msg: "collection not found"})
+				return
+			}
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		scope = "d.id IN (SELECT deck_id FROM collection_decks WHERE collection_id = ?)"
+		scopeArg = collectionID
+		deckOrder = "(SELECT cd.position FROM collection_decks cd WHERE cd.collection_id = ? AND cd.deck_id = d.id), "
+		orderArgs = []interface{}{collectionID}
+	}
+	if deckID := q.Get("deckId"); deckID != "" {
+		var tmp string
+		if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+				return
+			}
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		scope = "d.id = ?"
+		scopeArg = deckID
+	}
+	from := ` FROM cards c
+JOIN decks d ON d.id = c.deck_id
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE ` + scope
+	now := time.Now().UTC().Format(time.RFC3339)
+	prefs, err := fetchPreferences(s.db, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
+	}
+	reviewed, introduced, err := s.studiedToday(userID, loc)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	// Each kind of card is only served while today's cap allows it.
+	var c Card
+	err = sql.ErrNoRows
+	if reviewed < prefs.ReviewLimit {
+		err = s.db.QueryRow(`SELECT c.id, c.front, c.back, c.deck_id, COALESCE(c.hint, ''), c.images`+from+`
+AND cs.due_at <= ? ORDER BY `+deckOrder+`cs.due_at LIMIT 1`, append([]interface{}{userID, scopeArg, now}, orderArgs...)...).Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Hint, (*imageList)(&c.Images))
+	}
+	if errors.Is(err, sql.ErrNoRows) && introduced < prefs.NewCardsPerDay {
+		err = s.db.QueryRow(`SELECT c.id, c.front, c.back, c.deck_id, COALESCE(c.hint, ''), c.images`+from+`
+AND cs.card_id IS NULL ORDER BY `+deckOrder+`RANDOM() LIMIT 1`, append([]interface{}{userID, scopeArg}, orderArgs...)...).Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Hint, (*imageList)(&c.Images))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	cards := []Card{c}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	next := StudyCard{Card: cards[0]}
+	if next.Hint != "" {
+		next.HintDelaySeconds = &prefs.HintDelaySeconds
+	}
+	s.respondJSON(w, http.StatusOK, next)
+}
+
+// CramCard is a card served for cram study, with the deck it came from.
+type CramCard struct {
+	Card
+	DeckName string `json:"deckName"`
+}
+
+// GET /users/{userId}/cram?limit=&deckIds=a,b
+// Up to limit (default 50, max 200) random cards from the given decks, or
+// from all of the user's unarchived decks, regardless of schedule. Review
+// them with POST /cards/{cardId}/review?affectSchedule=false to leave the
+// real schedule alone.
+func (s *Server) cramHandler(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, 200)
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	where := "d.user_id = ? AND d.archived = 0"
+	args := []interface{}{userID}
+	if v := q.Get("deckIds"); v != "" {
+		var ids []interface{}
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "deckIds must list at least one deck"})
+			return
+		}
+		where = "d.user_id = ? AND d.id IN (" + placeholders(len(ids)) + ")"
+		args = append(args, ids...)
+	}
+	rows, err := s.db.Query(`SELECT c.id, c.front, c.back, c.deck_id, d.name FROM cards c
+JOIN decks d ON d.id = c.deck_id
+WHERE `+where+` ORDER BY RANDOM() LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	cards := []Card{}
+	var deckNames []string
+	for rows.Next() {
+		var c Card
+		var name string
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &name); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		cards = append(cards, c)
+		deckNames = append(deckNames, name)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	out := make([]CramCard, len(cards))
+	for i, c := range cards {
+		out[i] = CramCard{Card: c, DeckName: deckNames[i]}
+	}
+	s.respondJSON(w, http.StatusOK, out)
+}
+
+// GET /decks/{deckId}/progress?userId=
+// A card counts as studied once the user has a schedule for it, i.e. has
+// reviewed it at least once; mature means an interval of 21+ days.
+func (s *Server) deckProgressHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	p, err := s.deckProgress(deckID, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, p)
+}
+
+// DeckProgress is how far a user has got through a deck.
+type DeckProgress struct {
+	TotalCards      int `json:"totalCards"`
+	StudiedCards    int `json:"studiedCards"`
+	MatureCards     int `json:"matureCards"`
+	ProgressPercent int `json:"progressPercent"`
+}
+
+func (s *Server) deckProgress(deckID, userID string) (DeckProgress, error) {
+	var p DeckProgress
+	err := s.db.QueryRow(`SELECT COUNT(*),
+    COUNT(cs.card_id),
+    COALESCE(SUM(cs.interval_days >= 21), 0)
+FROM cards c
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE c.deck_id = ?`, userID, deckID).Scan(&p.TotalCards, &p.StudiedCards, &p.MatureCards)
+	if p.TotalCards > 0 {
+		p.ProgressPercent = int(math.Round(float64(p.StudiedCards) / float64(p.TotalCards) * 100))
+	}
+	return p, err
+}
+
+// DeckETA is the projection served by GET /decks/{deckId}/eta. Review cards
+// have an interval of at least a day, past the learning stage.
+type DeckETA struct {
+	TotalCards     int `json:"totalCards"`
+	ReviewCards    int `json:"reviewCards"`
+	LearningCards  int `json:"learningCards"`
+	NewCards       int `json:"newCards"`
+	NewCardsPerDay int `json:"newCardsPerDay"`
+	// DaysToGraduate is the user's average time from a card's first review
+	// to its first review leaving it with a 1+ day interval.
+	DaysToGraduate *float64 `json:"daysToGraduate"`
+	// EstimatedDate is the day, in the user's timezone, by which etaTarget
+	// of the cards should be in review. Null without enough history.
+	EstimatedDate *string `json:"estimatedDate"`
+}
+
+// etaTarget is the share of a deck's cards that must be in review for it to
+// count as finished; etaMinGraduations is how many graduated cards the user
+// needs in their history before DaysToGraduate is trusted.
+const (
+	etaTarget         = 0.9
+	etaMinGraduations = 5
+)
+
+// GET /decks/{deckId}/eta?userId=&tz=
+// When the deck should be finished: the new cards still needed are
+// introduced at the user's newCardsPerDay, and each then takes the user's
+// average time to graduate. Fields that can't be estimated are null.
+func (s *Server) deckETAHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
+	}
+	prefs, err := fetchPreferences(s.db, userID)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	var eta DeckETA
+	var studied int
+	err = s.db.QueryRow(`SELECT COUNT(*), COUNT(cs.card_id), COALESCE(SUM(cs.interval_days >= 1), 0)
+FROM cards c
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE c.deck_id = ?`, userID, deckID).Scan(&eta.TotalCards, &studied, &eta.ReviewCards)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	eta.LearningCards = studied - eta.ReviewCards
+	eta.NewCards = eta.TotalCards - studied
+	eta.NewCardsPerDay = prefs.NewCardsPerDay
+
+	var avgDays sql.NullFloat64
+	var graduated int
+	err = s.db.QueryRow(`WITH firsts AS (
+    SELECT card_id, MIN(reviewed_at) AS first_at FROM review_log WHERE user_id = ? GROUP BY card_id
+),
+grads AS (
+    SELECT card_id, MIN(reviewed_at) AS grad_at FROM review_log WHERE user_id = ? AND interval_after >= 1 GROUP BY card_id
+)
+SELECT AVG(julianday(g.grad_at) - julianday(f.first_at)), COUNT(*) FROM firsts f JOIN grads g ON g.card_id = f.card_id`,
+		userID, userID).Scan(&avgDays, &graduated)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if avgDays.Valid && graduated >= etaMinGraduations {
+		days := math.Round(avgDays.Float64*10) / 10
+		eta.DaysToGraduate = &days
+	}
+
+	today := time.Now().In(loc)
+	needed := int(math.Ceil(float64(eta.TotalCards)*etaTarget)) - eta.ReviewCards
+	var daysLeft float64
+	switch {
+	case needed <= 0:
+		daysLeft = 0
+	case eta.DaysToGraduate == nil:
+		s.respondJSON(w, http.StatusOK, eta)
+		return
+	default:
+		// Cards already in learning graduate first; the rest must be introduced.
+		newNeeded := max(needed-eta.LearningCards, 0)
+		if newNeeded > 0 && prefs.NewCardsPerDay == 0 {
+			s.respondJSON(w, http.StatusOK, eta)
+			return
+		}
+		if newNeeded > 0 {
+			// The last batch is introduced newNeeded/perDay days from now, counting today.
+			daysLeft = math.Ceil(float64(newNeeded)/float64(prefs.NewCardsPerDay)) - 1
+		}
+		daysLeft += *eta.DaysToGraduate
+	}
+	date := today.AddDate(0, 0, int(math.Ceil(daysLeft))).Format("2006-01-02")
+	eta.EstimatedDate = &date
+	s.respondJSON(w, http.StatusOK, eta)
+}
+
+// DeckComparison is one user's standing in GET /decks/{deckId}/compare.
+// Access says how they reach the deck, and DeckID is the deck actually
+// measured: the deck itself, or the user's copy of it.
+type DeckComparison struct {
+	Username string `json:"username"`
+	Access   string `json:"access"` // owner, collaborator or copy
+	DeckID   string `json:"deckId"`
+	DeckProgress
+	Reviews int `json:"reviews"`
+	// RetentionPercent is the share of reviews graded 3 or better; null
+	// before the first review.
+	RetentionPercent *int `json:"retentionPercent"`
+}
+
+// maxCompareUsers caps ?users= on GET /decks/{deckId}/compare.
+const maxCompareUsers = 100
+
+// GET /decks/{deckId}/compare?users=a,b,c (admin)
+// Side-by-side progress for users who own, collaborate on, or have copied
+// the deck. Listed users with none of those are returned in skipped.
+func (s *Server) compareDeckHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	var userIDs []string
+	for _, id := range strings.Split(r.URL.Query().Get("users"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !slices.Contains(userIDs, id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+	if len(userIDs) == 0 {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "users required"})
+		return
+	}
+	if len(userIDs) > maxCompareUsers {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: fmt.Sprintf("at most %d users", maxCompareUsers)})
+		return
+	}
+	var ownerID string
+	if err := s.db.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, deckID).Scan(&ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+
+	users := map[string]DeckComparison{}
+	skipped := []string{}
+	for _, userID := range userIDs {
+		c, ok, err := s.compareUser(deckID, ownerID, userID)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		if !ok {
+			skipped = append(skipped, userID)
+			continue
+		}
+		users[userID] = c
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"deckId":  deckID,
+		"users":   users,
+		"skipped": skipped,
+	})
+}
+
+// compareUser measures userID against deckID, reporting false when the user
+// doesn't exist or has no access to the deck or a copy of it.
+func (s *Server) compareUser(deckID, ownerID, userID string) (DeckComparison, bool, error) {
+	c := DeckComparison{DeckID: deckID}
+	if err := s.db.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&c.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c, false, nil
+		}
+		return c, false, err
+	}
+	switch {
+	case userID == ownerID:
+		c.Access = "owner"
+	default:
+		var collaborator bool
+		if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM deck_collaborators WHERE deck_id = ? AND user_id = ?)`, deckID, userID).Scan(&collaborator); err != nil {
+			return c, false, err
+		}
+		if collaborator {
+			c.Access = "collaborator"
+			break
+		}
+		// The most recent copy, should the user have made several.
+		err := s.db.QueryRow(`SELECT id FROM decks WHERE user_id = ? AND copied_from = ? ORDER BY rowid DESC LIMIT 1`, userID, deckID).Scan(&c.DeckID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c, false, nil
+		}
+		if err != nil {
+			return c, false, err
+		}
+		c.Access = "copy"
+	}
+
+	var err error
+	if c.DeckProgress, err = s.deckProgress(c.DeckID, userID); err != nil {
+		return c, false, err
+	}
+	var recalled int
+	if err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(rl.quality >= 3), 0)
+FROM review_log rl JOIN cards c ON c.id = rl.card_id
+WHERE c.deck_id = ? AND rl.user_id = ?`, c.DeckID, userID).Scan(&c.Reviews, &recalled); err != nil {
+		return c, false, err
+	}
+	if c.Reviews > 0 {
+		pct := int(math.Round(float64(recalled) / float64(c.Reviews) * 100))
+		c.RetentionPercent = &pct
+	}
+	return c, true, nil
+}
+
+// OverdueCard is a due card with how many whole days it is past due.
+type OverdueCard struct {
+	Card
+	DueAt       string `json:"dueAt"`
+	OverdueDays int    `json:"overdueDays"`
+}
+
+// GET /decks/{deckId}/overdue?userId=&limit=&offset=
+// The user's due cards in the deck, most overdue first. Never-reviewed cards
+// have no due date and are left out. The list stops at what is left of the
+// user's daily reviewLimit.
+func (s *Server) overdueCardsHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	userID := r.URL.Query().Get("userId")
+	if strings.TrimSpace(userID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId required"})
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	if strings.TrimSpace(req.Username) == "" {
-		respondError(w, http.StatusBadRequest, "username required")
+	now := time.Now().UTC()
+	from := ` FROM cards c
+JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE c.deck_id = ? AND cs.due_at <= ?`
+	args := []interface{}{userID, deckID, now.Format(time.RFC3339)}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	id := genID()
-	_, err := db.Exec(`INSERT INTO users(id, username) VALUES (?, ?)`, id, req.Username)
+	prefs, err := fetchPreferences(s.db, userID)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE") {
-			respondError(w, http.StatusConflict, "username already exists")
-			return
-		}
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	user := User{ID: id, Username: req.Username}
-	respondJSON(w, http.StatusCreated, user)
-}
-
-// GET /users?username= (partial match)
-func listUsersHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query().Get("username")
-	var rows *sql.Rows
-	var err error
-	if q == "" {
-		rows, err = db.Query(`SELECT id, username FROM users`)
-	} else {
-		rows, err = db.Query(`SELECT id, username FROM users WHERE username LIKE ?`, "%"+q+"%")
+	loc, ok := s.userLocation(r, userID)
+	if !ok {
+		return
 	}
+	reviewed, _, err := s.studiedToday(userID, loc)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	total = min(total, max(prefs.ReviewLimit-reviewed, 0))
+	pageSize := min(limit, max(total-offset, 0))
+	rows, err := s.db.Query(`SELECT c.id, c.front, c.back, c.deck_id, cs.due_at`+from+`
+ORDER BY cs.due_at, c.rowid LIMIT ? OFFSET ?`, append(args, pageSize, offset)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
 	defer rows.Close()
-	var out []User
+	cards := []Card{}
+	var dues []string
 	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Username); err != nil {
-			respondError(w, http.StatusInternalServerError, "db error")
+		var c Card
+		var due string
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &due); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 			return
 		}
-		out = append(out, u)
+		cards = append(cards, c)
+		dues = append(dues, due)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	if err := s.attachCardTags(cards); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	items := make([]OverdueCard, len(cards))
+	for i, c := range cards {
+		items[i] = OverdueCard{Card: c, DueAt: dues[i]}
+		if due, err := time.Parse(time.RFC3339, dues[i]); err == nil {
+			items[i].OverdueDays = int(now.Sub(due).Hours() / 24)
+		}
 	}
-	respondJSON(w, http.StatusOK, out)
+	s.respondJSON(w, http.StatusOK, Page{Items: items, Total: total, Limit: limit, Offset: offset})
 }
 
-// GET /users/{userId}
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "userId")
-	var u User
-	err := db.QueryRow(`SELECT id, username FROM users WHERE id = ?`, id).Scan(&u.ID, &u.Username)
+/* ---------- Handlers: Offline study ---------- */
+
+// offlineTokenTTL is how long an offline study token stays valid.
+const offlineTokenTTL = 24 * time.Hour
+
+// OfflineClaims is the payload of an offline study token. IssuedAt lets the
+// server tell which cards changed after the client took its copy.
+type OfflineClaims struct {
+	Subject   string        `json:"sub"` // user ID
+	IssuedAt  int64         `json:"iat"`
+	ExpiresAt int64         `json:"exp"`
+	Deck      OfflineDeck   `json:"deck"`
+	Cards     []OfflineCard `json:"cards"`
+}
+
+type OfflineDeck struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type OfflineCard struct {
+	ID          string  `json:"id"`
+	Front       string  `json:"front"`
+	Back        string  `json:"back"`
+	EaseFactor  float64 `json:"easeFactor"`
+	Interval    int     `json:"interval"`
+	Repetitions int     `json:"repetitions"`
+	DueAt       string  `json:"dueAt"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signJWT encodes claims as an HS256 JSON Web Token.
+func signJWT(claims interface{}, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			respondError(w, http.StatusNotFound, "user not found")
-			return
-		}
-		respondError(w, http.StatusInternalServerError, "db error")
-		return
+		return "", err
 	}
-	respondJSON(w, http.StatusOK, u)
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
 }
 
-/* ---------- Handlers: Decks ---------- */
-
-// POST /decks
-// body: { name, description, userId, cards?: [{front,back}, ...] }
-func createDeckHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Name        string        `json:"name"`
-		Description string        `json:"description"`
-		UserID      string        `json:"userId"`
-		Cards       []CardRequest `json:"cards"`
+// verifyJWT checks an HS256 token's signature and expiry and decodes its
+// payload into claims. Only tokens made by signJWT are accepted.
+func verifyJWT(token string, secret []byte, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return errors.New("malformed token")
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid json")
-		return
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token")
 	}
-	if strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.UserID) == "" {
-		respondError(w, http.StatusBadRequest, "name and userId required")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("invalid signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	var exp struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err != nil || json.Unmarshal(payload, claims) != nil || json.Unmarshal(payload, &exp) != nil {
+		return errors.New("malformed token")
+	}
+	if time.Now().Unix() >= exp.ExpiresAt {
+		return errors.New("token expired")
+	}
+	return nil
+}
+
+// POST /study/offline-token?userId=&deckId=
+// Returns a signed token carrying the whole deck and the user's SM-2 state
+// for each card, valid for offlineTokenTTL. Reviews made offline go back
+// through POST /study/bulk-review along with the token.
+func (s *Server) offlineTokenHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID, deckID := q.Get("userId"), q.Get("deckId")
+	if strings.TrimSpace(userID) == "" || strings.TrimSpace(deckID) == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "userId and deckId required"})
 		return
 	}
-	// Ensure user exists
 	var tmp string
-	if err := db.QueryRow(`SELECT id FROM users WHERE id = ?`, req.UserID).Scan(&tmp); err != nil {
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE id = ?`, userID).Scan(&tmp); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			respondError(w, http.StatusBadRequest, "user does not exist")
+			setError(r.Context(), AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found"})
 			return
 		}
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	now := time.Now().UTC()
+	claims := OfflineClaims{Subject: userID, IssuedAt: now.Unix(), ExpiresAt: now.Add(offlineTokenTTL).Unix(), Cards: []OfflineCard{}}
+	if err := s.db.QueryRow(`SELECT id, name FROM decks WHERE id = ?`, deckID).Scan(&claims.Deck.ID, &claims.Deck.Name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
+			return
+		}
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	defer tx.Rollback()
-
-	deckID := genID()
-	_, err = tx.Exec(`INSERT INTO decks(id, name, description, user_id) VALUES (?, ?, ?, ?)`, deckID, req.Name, req.Description, req.UserID)
+	fresh := newSchedule("", userID, now)
+	rows, err := s.db.Query(`SELECT c.id, c.front, c.back,
+    COALESCE(cs.ease_factor, ?), COALESCE(cs.interval_days, 0), COALESCE(cs.repetitions, 0), COALESCE(cs.due_at, ?)
+FROM cards c
+LEFT JOIN card_schedules cs ON cs.card_id = c.id AND cs.user_id = ?
+WHERE c.deck_id = ? ORDER BY c.position, c.rowid`, fresh.EaseFactor, fresh.DueAt, userID, deckID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	// insert cards if any
-	for _, c := range req.Cards {
-		cardID := genID()
-		if strings.TrimSpace(c.Front) == "" || strings.TrimSpace(c.Back) == "" {
-			respondError(w, http.StatusBadRequest, "card front/back required")
-			return
-		}
-		if _, err := tx.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, cardID, deckID, c.Front, c.Back); err != nil {
-			respondError(w, http.StatusInternalServerError, "db error")
+	defer rows.Close()
+	for rows.Next() {
+		var c OfflineCard
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.EaseFactor, &c.Interval, &c.Repetitions, &c.DueAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 			return
 		}
+		claims.Cards = append(claims.Cards, c)
 	}
-
-	if err := tx.Commit(); err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-
-	deck, err := fetchDeckByID(deckID)
+	token, err := signJWT(claims, s.config.StudyTokenSecret)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not generate token"})
 		return
 	}
-	respondJSON(w, http.StatusCreated, deck)
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"token":     token,
+		"expiresAt": time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
+	})
 }
 
-type CardRequest struct {
-	Front string `json:"front"`
-	Back  string `json:"back"`
+/* ---------- Handlers: Audit ---------- */
+
+type AuditEntry struct {
+	ID        string          `json:"id"`
+	DeckID    string          `json:"deckId"`
+	UserID    string          `json:"userId,omitempty"`
+	Action    string          `json:"action"`
+	Detail    json.RawMessage `json:"detail,omitempty"`
+	CreatedAt string          `json:"createdAt"`
 }
 
-// GET /decks?name=  (partial match)
-func listDecksHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query().Get("name")
-	var rows *sql.Rows
-	var err error
-	if q == "" {
-		rows, err = db.Query(`SELECT id FROM decks`)
-	} else {
-		rows, err = db.Query(`SELECT id FROM decks WHERE name LIKE ?`, "%"+q+"%")
+// recordAudit appends an entry to the deck's audit trail. It is best-effort:
+// failures are logged and never fail the mutation being audited.
+func (s *Server) recordAudit(deckID, userID, action string, detail interface{}) {
+	var detailJSON interface{}
+	if detail != nil {
+		b, err := json.Marshal(detail)
+		if err != nil {
+			s.logger.Warn("audit write failed", "action", action, "deckId", deckID, "err", err)
+			return
+		}
+		detailJSON = string(b)
+	}
+	var user interface{}
+	if userID != "" {
+		user = userID
 	}
+	_, err := s.db.Exec(`INSERT INTO deck_audit(id, deck_id, user_id, action, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		genID(), deckID, user, action, detailJSON, time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
-		return
+		s.logger.Warn("audit write failed", "action", action, "deckId", deckID, "err", err)
 	}
-	defer rows.Close()
+}
 
-	var decks []Deck
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			respondError(w, http.StatusInternalServerError, "db error")
+// GET /decks/{deckId}/audit?limit=  (newest first, default 50, max 500)
+func (s *Server) listDeckAuditHandler(w http.ResponseWriter, r *http.Request) {
+	deckID := chi.URLParam(r, "deckId")
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "limit must be a positive integer"})
 			return
 		}
-		d, err := fetchDeckByID(id)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, "db error")
+		limit = min(n, 500)
+	}
+	var tmp string
+	if err := s.db.QueryRow(`SELECT id FROM decks WHERE id = ?`, deckID).Scan(&tmp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			setError(r.Context(), AppError{Code: ErrCodeDeckNotFound, Status: http.StatusNotFound, Msg: "deck not found"})
 			return
 		}
-		decks = append(decks, d)
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
 	}
-	respondJSON(w, http.StatusOK, decks)
-}
-
-// GET /decks/{deckId}
-func getDeckHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "deckId")
-	d, err := fetchDeckByID(id)
+	rows, err := s.db.Query(`SELECT id, deck_id, user_id, action, detail, created_at FROM deck_audit
+WHERE deck_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?`, deckID, limit)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			respondError(w, http.StatusNotFound, "deck not found")
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var userID, detail sql.NullString
+		if err := rows.Scan(&e.ID, &e.DeckID, &userID, &e.Action, &detail, &e.CreatedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 			return
 		}
-		respondError(w, http.StatusInternalServerError, "db error")
+		e.UserID = userID.String
+		if detail.Valid {
+			e.Detail = json.RawMessage(detail.String)
+		}
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	respondJSON(w, http.StatusOK, d)
+	s.respondJSON(w, http.StatusOK, out)
 }
 
-func fetchDeckByID(id string) (Deck, error) {
-	var d Deck
-	var desc sql.NullString
-	err := db.QueryRow(`SELECT id, name, description, user_id FROM decks WHERE id = ?`, id).Scan(&d.ID, &d.Name, &desc, &d.UserID)
+/* ---------- Handlers: Admin ---------- */
+
+// GET /admin/flagged-cards?flag=&limit=&offset=
+// Flagged cards across all decks, most useful for curating public decks.
+func (s *Server) listFlaggedCardsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
 	if err != nil {
-		return d, err
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
+		return
+	}
+	where := "flag IS NOT NULL"
+	args := []interface{}{}
+	if v := r.URL.Query().Get("flag"); v != "" {
+		if !validCardFlags[v] {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "flag must be one of needs-review, confusing, outdated"})
+			return
+		}
+		where = "flag = ?"
+		args = append(args, v)
 	}
-	if desc.Valid {
-		d.Description = desc.String
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM cards WHERE `+where, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
 	}
-	// fetch cards
-	rows, err := db.Query(`SELECT id, front, back FROM cards WHERE deck_id = ?`, id)
+	rows, err := s.db.Query(`SELECT id, front, back, deck_id, flag FROM cards WHERE `+where+`
+ORDER BY deck_id, rowid LIMIT ? OFFSET ?`, append(args, limit, offset)...)
 	if err != nil {
-		return d, err
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+		return
 	}
 	defer rows.Close()
+	cards := []Card{}
 	for rows.Next() {
 		var c Card
-		if err := rows.Scan(&c.ID, &c.Front, &c.Back); err != nil {
-			return d, err
+		if err := rows.Scan(&c.ID, &c.Front, &c.Back, &c.DeckID, &c.Flag); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
 		}
-		d.Cards = append(d.Cards, c)
-	}
-	return d, nil
-}
-
-// PATCH /decks/{deckId}  (partial)
-func patchDeckHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "deckId")
-	var patch struct {
-		Name        *string `json:"name"`
-		Description *string `json:"description"`
+		cards = append(cards, c)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid json")
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	updates := map[string]interface{}{}
-	if patch.Name != nil {
-		updates["name"] = *patch.Name
-	}
-	if patch.Description != nil {
-		updates["description"] = *patch.Description
-	}
-	if len(updates) == 0 {
-		respondError(w, http.StatusBadRequest, "no fields to update")
+	s.respondJSON(w, http.StatusOK, Page{Items: cards, Total: total, Limit: limit, Offset: offset})
+}
+
+// DeckReport is a user's report of a public deck.
+type DeckReport struct {
+	ID             string `json:"id"`
+	DeckID         string `json:"deckId"`
+	DeckName       string `json:"deckName,omitempty"`
+	ReporterUserID string `json:"reporterUserId"`
+	Reason         string `json:"reason"`
+	CreatedAt      string `json:"createdAt"`
+}
+
+// GET /admin/reports?deckId=&limit=&offset=
+// Deck reports, newest first, optionally for one deck.
+func (s *Server) listDeckReportsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
 		return
 	}
-	setParts := []string{}
+	where := "1 = 1"
 	args := []interface{}{}
-	for k, v := range updates {
-		setParts = append(setParts, fmt.Sprintf("%s = ?", k))
+	if v := r.URL.Query().Get("deckId"); v != "" {
+		where = "dr.deck_id = ?"
 		args = append(args, v)
 	}
-	args = append(args, id)
-	query := fmt.Sprintf("UPDATE decks SET %s WHERE id = ?", strings.Join(setParts, ", "))
-	res, err := db.Exec(query, args...)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM deck_reports dr WHERE `+where, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	rowsAff, _ := res.RowsAffected()
-	if rowsAff == 0 {
-		respondError(w, http.StatusNotFound, "deck not found")
+	rows, err := s.db.Query(`SELECT dr.id, dr.deck_id, d.name, dr.reporter_user_id, dr.reason, dr.created_at
+FROM deck_reports dr JOIN decks d ON d.id = dr.deck_id WHERE `+where+`
+ORDER BY dr.created_at DESC, dr.rowid DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	d, err := fetchDeckByID(id)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	defer rows.Close()
+	reports := []DeckReport{}
+	for rows.Next() {
+		var d DeckReport
+		if err := rows.Scan(&d.ID, &d.DeckID, &d.DeckName, &d.ReporterUserID, &d.Reason, &d.CreatedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
+			return
+		}
+		reports = append(reports, d)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	respondJSON(w, http.StatusOK, d)
+	s.respondJSON(w, http.StatusOK, Page{Items: reports, Total: total, Limit: limit, Offset: offset})
 }
 
-// DELETE /decks/{deckId}
-func deleteDeckHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "deckId")
-	res, err := db.Exec(`DELETE FROM decks WHERE id = ?`, id)
+// reviewSnippetLen caps how much of a card's front GET /admin/reviews returns.
+const reviewSnippetLen = 80
+
+// AdminReview is one review_log entry as seen by GET /admin/reviews.
+type AdminReview struct {
+	ID             string  `json:"id"`
+	CardID         string  `json:"cardId"`
+	DeckID         string  `json:"deckId"`
+	UserID         string  `json:"userId"`
+	Front          string  `json:"front"`
+	Quality        int     `json:"quality"`
+	IntervalBefore int     `json:"intervalBefore"`
+	IntervalAfter  int     `json:"intervalAfter"`
+	EaseBefore     float64 `json:"easeBefore"`
+	EaseAfter      float64 `json:"easeAfter"`
+	ReviewedAt     string  `json:"reviewedAt"`
+}
+
+// GET /admin/reviews?userId=&deckId=&date=YYYY-MM-DD&limit=&offset=
+// Review log entries, newest first. All filters are optional; date is a UTC
+// day. front is cut to reviewSnippetLen characters.
+func (s *Server) listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: err.Error()})
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		respondError(w, http.StatusNotFound, "deck not found")
-		return
+	q := r.URL.Query()
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if v := q.Get("userId"); v != "" {
+		conds = append(conds, "rl.user_id = ?")
+		args = append(args, v)
 	}
-	w.WriteHeader(http.StatusNoContent)
-}
-
-/* ---------- Handlers: Cards ---------- */
-
-// POST /cards
-// body: { deckId, front, back }
-func createCardHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		DeckID string `json:"deckId"`
-		Front  string `json:"front"`
-		Back   string `json:"back"`
+	if v := q.Get("deckId"); v != "" {
+		conds = append(conds, "c.deck_id = ?")
+		args = append(args, v)
+	}
+	if v := q.Get("date"); v != "" {
+		day, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "date must be YYYY-MM-DD"})
+			return
+		}
+		conds = append(conds, "rl.reviewed_at >= ? AND rl.reviewed_at < ?")
+		args = append(args, day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339))
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid json")
+	from := ` FROM review_log rl JOIN cards c ON c.id = rl.card_id WHERE ` + strings.Join(conds, " AND ")
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	if strings.TrimSpace(req.DeckID) == "" || strings.TrimSpace(req.Front) == "" || strings.TrimSpace(req.Back) == "" {
-		respondError(w, http.StatusBadRequest, "deckId, front and back required")
+	rows, err := s.db.Query(`SELECT rl.id, rl.card_id, c.deck_id, rl.user_id, c.front, rl.quality,
+    rl.interval_before, rl.interval_after, rl.ease_before, rl.ease_after, rl.reviewed_at`+from+`
+ORDER BY rl.reviewed_at DESC, rl.rowid DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	// ensure deck exists
-	var tmp string
-	if err := db.QueryRow(`SELECT id FROM decks WHERE id = ?`, req.DeckID).Scan(&tmp); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			respondError(w, http.StatusBadRequest, "deck does not exist")
+	defer rows.Close()
+	reviews := []AdminReview{}
+	for rows.Next() {
+		var rv AdminReview
+		if err := rows.Scan(&rv.ID, &rv.CardID, &rv.DeckID, &rv.UserID, &rv.Front, &rv.Quality,
+			&rv.IntervalBefore, &rv.IntervalAfter, &rv.EaseBefore, &rv.EaseAfter, &rv.ReviewedAt); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 			return
 		}
-		respondError(w, http.StatusInternalServerError, "db error")
+		if runes := []rune(rv.Front); len(runes) > reviewSnippetLen {
+			rv.Front = string(runes[:reviewSnippetLen]) + "…"
+		}
+		reviews = append(reviews, rv)
+	}
+	if err := rows.Err(); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "db error"})
 		return
 	}
-	id := genID()
-	_, err := db.Exec(`INSERT INTO cards(id, deck_id, front, back) VALUES (?, ?, ?, ?)`, id, req.DeckID, req.Front, req.Back)
+	s.respondJSON(w, http.StatusOK, Page{Items: reviews, Total: total, Limit: limit, Offset: offset})
+}
+
+// orphanChecks lists rows whose parent row is gone. Foreign keys prevent new
+// orphans, but databases written before they were enforced may have some.
+var orphanChecks = []struct {
+	Name  string
+	Table string
+	Where string
+}{
+	{"cardsWithoutDeck", "cards", "deck_id NOT IN (SELECT id FROM decks)"},
+	{"decksWithoutUser", "decks", "user_id NOT IN (SELECT id FROM users)"},
+	{"schedulesWithoutCard", "card_schedules", "card_id NOT IN (SELECT id FROM cards)"},
+	{"schedulesWithoutUser", "card_schedules", "user_id NOT IN (SELECT id FROM users)"},
+	{"reviewsWithoutCard", "review_log", "card_id NOT IN (SELECT id FROM cards)"},
+	{"reviewsWithoutUser", "review_log", "user_id NOT IN (SELECT id FROM users)"},
+	{"cardTagsWithoutCard", "card_tags", "card_id NOT IN (SELECT id FROM cards)"},
+	{"cardTagsWithoutTag", "card_tags", "tag_id NOT IN (SELECT id FROM tags)"},
+	{"deckTagsWithoutDeck", "deck_tags", "deck_id NOT IN (SELECT id FROM decks)"},
+	{"deckTagsWithoutTag", "deck_tags", "tag_id NOT IN (SELECT id FROM tags)"},
+	{"translationsWithoutCard", "card_translations", "card_id NOT IN (SELECT id FROM cards)"},
+	{"collaboratorsWithoutDeck", "deck_collaborators", "deck_id NOT IN (SELECT id FROM decks)"},
+	{"collaboratorsWithoutUser", "deck_collaborators", "user_id NOT IN (SELECT id FROM users)"},
+	{"shareLinksWithoutDeck", "share_links", "deck_id NOT IN (SELECT id FROM decks)"},
+	{"collectionDecksWithoutDeck", "collection_decks", "deck_id NOT IN (SELECT id FROM decks)"},
+	{"auditWithoutDeck", "deck_audit", "deck_id NOT IN (SELECT id FROM decks)"},
+}
+
+// POST /admin/integrity-check?fix=true
+// Counts orphaned rows per category. With fix=true the orphans are deleted in
+// one transaction and the counts report what was removed directly; rows
+// hanging off a removed orphan go with it through ON DELETE CASCADE.
+func (s *Server) integrityCheckHandler(w http.ResponseWriter, r *http.Request) {
+	fix := false
+	if v := r.URL.Query().Get("fix"); v != "" {
+		var err error
+		if fix, err = strconv.ParseBool(v); err != nil {
+			setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "fix must be true or false"})
+			return
+		}
+	}
+	orphans := map[string]int64{}
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		for _, c := range orphanChecks {
+			if fix {
+				res, err := tx.Exec(`DELETE FROM ` + c.Table + ` WHERE ` + c.Where)
+				if err != nil {
+					return err
+				}
+				orphans[c.Name], _ = res.RowsAffected()
+				continue
+			}
+			var n int64
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM ` + c.Table + ` WHERE ` + c.Where).Scan(&n); err != nil {
+				return err
+			}
+			orphans[c.Name] = n
+		}
+		return nil
+	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+		setTxError(r.Context(), err)
 		return
 	}
-	card := Card{ID: id, Front: req.Front, Back: req.Back, DeckID: req.DeckID}
-	respondJSON(w, http.StatusCreated, card)
+	if fix {
+		s.logger.Info("integrity check fixed orphans", "orphans", orphans)
+	}
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{"fixed": fix, "orphans": orphans})
 }
 
-// PATCH /cards/{cardId}
-func patchCardHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "cardId")
-	var patch struct {
-		Front *string `json:"front"`
-		Back  *string `json:"back"`
+// GET /admin/backup
+// Streams a consistent snapshot of the database. VACUUM INTO writes the copy
+// from a read transaction, so live traffic keeps going while it runs.
+func (s *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := os.MkdirTemp("", "flashcards-backup-")
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not create backup"})
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid json")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	if _, err := s.db.ExecContext(r.Context(), `VACUUM INTO ?`, path); err != nil {
+		s.logger.Error("backup failed", "err", err)
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not create backup"})
 		return
 	}
-	updates := map[string]interface{}{}
-	if patch.Front != nil {
-		updates["front"] = *patch.Front
+	f, err := os.Open(path)
+	if err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInternal, Status: http.StatusInternalServerError, Msg: "could not create backup"})
+		return
 	}
-	if patch.Back != nil {
-		updates["back"] = *patch.Back
+	defer f.Close()
+	name := "flashcards-" + time.Now().UTC().Format("20060102-150405") + ".db"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if fi, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
 	}
-	if len(updates) == 0 {
-		respondError(w, http.StatusBadRequest, "no fields to update")
-		return
+	if _, err := io.Copy(w, f); err != nil {
+		s.logger.Warn("backup download interrupted", "err", err)
 	}
-	setParts := []string{}
-	args := []interface{}{}
-	for k, v := range updates {
-		setParts = append(setParts, fmt.Sprintf("%s = ?", k))
-		args = append(args, v)
+}
+
+// POST /admin/users/merge
+// body: { keepId, mergeId }
+// Moves every deck owned by mergeId (cards come along) to keepId, then
+// deletes mergeId; the merged user's own study history goes with it. A
+// moved deck whose name the kept user already has is renamed "name (2)",
+// "name (3)", and so on.
+func (s *Server) mergeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		KeepID  string `json:"keepId"`
+		MergeID string `json:"mergeId"`
 	}
-	args = append(args, id)
-	query := fmt.Sprintf("UPDATE cards SET %s WHERE id = ?", strings.Join(setParts, ", "))
-	res, err := db.Exec(query, args...)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	if err := decodeJSON(r, &req); err != nil {
+		setError(r.Context(), AppError{Code: ErrCodeInvalidBody, Status: http.StatusBadRequest, Msg: err.Error()})
 		return
 	}
-	rowsAff, _ := res.RowsAffected()
-	if rowsAff == 0 {
-		respondError(w, http.StatusNotFound, "card not found")
+	if req.KeepID == "" || req.MergeID == "" {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "keepId and mergeId required"})
 		return
 	}
-	// return updated card
-	var c Card
-	err = db.QueryRow(`SELECT id, front, back, deck_id FROM cards WHERE id = ?`, id).Scan(&c.ID, &c.Front, &c.Back, &c.DeckID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
+	if req.KeepID == req.MergeID {
+		setError(r.Context(), AppError{Code: ErrCodeValidation, Status: http.StatusBadRequest, Msg: "keepId and mergeId must differ"})
 		return
 	}
-	respondJSON(w, http.StatusOK, c)
-}
 
-// DELETE /cards/{cardId}
-func deleteCardHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "cardId")
-	res, err := db.Exec(`DELETE FROM cards WHERE id = ?`, id)
+	var moved, renamed int
+	err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+		for _, id := range []string{req.KeepID, req.MergeID} {
+			var tmp string
+			if err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, id).Scan(&tmp); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return AppError{Code: ErrCodeUserNotFound, Status: http.StatusNotFound, Msg: "user not found: " + id}
+				}
+				return err
+			}
+		}
+
+		taken := map[string]bool{}
+		rows, err := tx.Query(`SELECT name FROM decks WHERE user_id = ?`, req.KeepID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			taken[name] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		type movedDeck struct{ id, name string }
+		var moving []movedDeck
+		rows, err = tx.Query(`SELECT id, name FROM decks WHERE user_id = ? ORDER BY rowid`, req.MergeID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var d movedDeck
+			if err := rows.Scan(&d.id, &d.name); err != nil {
+				rows.Close()
+				return err
+			}
+			moving = append(moving, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, d := range moving {
+			name := d.name
+			for n := 2; taken[name]; n++ {
+				name = fmt.Sprintf("%s (%d)", d.name, n)
+			}
+			if name != d.name {
+				renamed++
+			}
+			taken[name] = true
+			if _, err := tx.Exec(`UPDATE decks SET user_id = ?, name = ? WHERE id = ?`, req.KeepID, name, d.id); err != nil {
+				return err
+			}
+			// The kept user may have been a collaborator on a deck they now own.
+			if _, err := tx.Exec(`DELETE FROM deck_collaborators WHERE deck_id = ? AND user_id = ?`, d.id, req.KeepID); err != nil {
+				return err
+			}
+		}
+		moved = len(moving)
+		_, err = tx.Exec(`DELETE FROM users WHERE id = ?`, req.MergeID)
+		return err
+	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "db error")
-		return
-	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		respondError(w, http.StatusNotFound, "card not found")
+		setTxError(r.Context(), err)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	s.logger.Info("users merged", "keepId", req.KeepID, "mergeId", req.MergeID, "decksMoved", moved)
+	s.respondJSON(w, http.StatusOK, map[string]int{"decksMoved": moved, "decksRenamed": renamed})
 }
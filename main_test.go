@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server backed by a fresh, migrated SQLite database
+// in a temporary directory, with config as loaded from an empty environment.
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "flashcards.db")+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	cfg := loadConfig()
+	cfg.AuthTokenSecret = []byte("test-secret")
+	if err := setCardLimit(db, cfg.MaxCardsPerDeck); err != nil {
+		t.Fatalf("card limit: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &Server{db: db, config: cfg, logger: logger, mailer: newEmailer(cfg, logger),
+		usernameChecks: newRateLimiter(cfg.UsernameCheckRateLimit, time.Minute)}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// doJSON sends body as JSON and decodes the response into out, if given.
+func doJSON(t *testing.T, method, url string, body, out interface{}) int {
+	t.Helper()
+	return sendJSON(t, "", method, url, body, out)
+}
+
+// doJSONAs is doJSON with an access token for userID.
+func doJSONAs(t *testing.T, s *Server, userID, method, url string, body, out interface{}) int {
+	t.Helper()
+	token, _, err := s.issueAccessToken(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sendJSON(t, token, method, url, body, out)
+}
+
+// sendJSON is doJSON sending token as the bearer token, if not empty.
+func sendJSON(t *testing.T, token, method, url string, body, out interface{}) int {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// createTestUser makes a user through the API and returns its ID.
+func createTestUser(t *testing.T, ts *httptest.Server, username string) string {
+	t.Helper()
+	var u User
+	if code := doJSON(t, http.MethodPost, ts.URL+"/users", map[string]string{"username": username}, &u); code != http.StatusCreated {
+		t.Fatalf("create user: status %d", code)
+	}
+	return u.ID
+}
+
+func TestCreateDeckConcurrentSameName(t *testing.T) {
+	s, ts := newTestServer(t)
+	userID := createTestUser(t, ts, "alice")
+
+	body, err := json.Marshal(map[string]string{"name": "Spanish", "userId": userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 10
+	codes := make([]int, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(ts.URL+"/decks", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("request %d: status %d, want 201 or 409", i, code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d requests created the deck, want 1", created)
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM decks WHERE user_id = ? AND name = ?`, userID, "Spanish").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d decks named Spanish, want 1", n)
+	}
+}
+
+func TestInsertWithSlugRetriesOnCollision(t *testing.T) {
+	s, ts := newTestServer(t)
+	alice := createTestUser(t, ts, "alice")
+	bob := createTestUser(t, ts, "bob")
+
+	var first Deck
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", map[string]string{"name": "Spanish", "userId": alice}, &first); code != http.StatusCreated {
+		t.Fatalf("create deck: status %d", code)
+	}
+	// A second ID sharing the first four characters gets the same deckSlug.
+	deckID := first.ID[:4] + genID()[4:]
+	err := insertWithSlug("Spanish", deckID, func(slug string) error {
+		_, err := s.db.Exec(`INSERT INTO decks(id, name, user_id, slug) VALUES (?, ?, ?, ?)`, deckID, "Spanish", bob, slug)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("insertWithSlug: %v", err)
+	}
+	var slug string
+	if err := s.db.QueryRow(`SELECT slug FROM decks WHERE id = ?`, deckID).Scan(&slug); err != nil {
+		t.Fatal(err)
+	}
+	if slug == first.Slug {
+		t.Errorf("second deck reused slug %q", slug)
+	}
+}
+
+func TestCreateDeckInvalidCardLeavesNoDeck(t *testing.T) {
+	s, ts := newTestServer(t)
+	userID := createTestUser(t, ts, "alice")
+
+	body := map[string]interface{}{
+		"name":   "Spanish",
+		"userId": userID,
+		"cards": []map[string]string{
+			{"front": "hola", "back": "hello"},
+			{"front": "adiós", "back": ""},
+		},
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", body, nil); code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", code)
+	}
+	var decks, cards int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM decks WHERE user_id = ?`, userID).Scan(&decks); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM cards`).Scan(&cards); err != nil {
+		t.Fatal(err)
+	}
+	if decks != 0 || cards != 0 {
+		t.Errorf("left %d decks and %d cards behind, want none", decks, cards)
+	}
+}
+
+func TestCreateDeckWithoutCardsReturnsEmptyArray(t *testing.T) {
+	_, ts := newTestServer(t)
+	userID := createTestUser(t, ts, "alice")
+
+	var deck map[string]json.RawMessage
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", map[string]string{"name": "Spanish", "userId": userID}, &deck); code != http.StatusCreated {
+		t.Fatalf("status %d, want 201", code)
+	}
+	if got := string(deck["cards"]); got != "[]" {
+		t.Errorf(`"cards" = %s, want []`, got)
+	}
+}
+
+func TestRunMigrationsIdempotent(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "flashcards.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	var schemas []string
+	for i := range 3 {
+		if err := runMigrations(db); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		schemas = append(schemas, dumpSchema(t, db))
+	}
+	for i := 1; i < len(schemas); i++ {
+		if schemas[i] != schemas[0] {
+			t.Errorf("schema after run %d differs from run 1:\n%s\n---\n%s", i+1, schemas[i], schemas[0])
+		}
+	}
+}
+
+// dumpSchema lists every table, index and trigger with its SQL.
+func dumpSchema(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name, COALESCE(sql, '') FROM sqlite_master ORDER BY type, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var typ, name, def string
+		if err := rows.Scan(&typ, &name, &def); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "%s %s: %s\n", typ, name, def)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// sentMail records what the server mailed.
+type sentMail struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (m *sentMail) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	s, ts := newTestServer(t)
+	mail := &sentMail{}
+	s.mailer = mail
+	s.config.PasswordResetURL = "https://app.example/reset-password"
+	userID := createTestUser(t, ts, "alice")
+	if _, err := s.db.Exec(`UPDATE users SET email = 'alice@example.com', email_verified = 1 WHERE id = ?`, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/forgot-password", map[string]string{"email": "alice@example.com"}, nil); code != http.StatusAccepted {
+		t.Fatalf("forgot-password: status %d, want 202", code)
+	}
+	if len(mail.bodies) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(mail.bodies))
+	}
+	_, token, ok := strings.Cut(mail.bodies[0], "/reset-password?token=")
+	if !ok {
+		t.Fatalf("no reset link in %q", mail.bodies[0])
+	}
+	token, _, _ = strings.Cut(token, "\n")
+
+	reset := map[string]string{"token": token, "newPassword": "correct horse"}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/reset-password", reset, nil); code != http.StatusNoContent {
+		t.Fatalf("reset-password: status %d, want 204", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/reset-password", reset, nil); code != http.StatusBadRequest {
+		t.Errorf("reusing the token: status %d, want 400", code)
+	}
+	var pair TokenPair
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/login", map[string]string{"username": "alice", "password": "correct horse"}, &pair); code != http.StatusOK || pair.Token == "" {
+		t.Errorf("login: status %d, token %q", code, pair.Token)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/login", map[string]string{"username": "alice", "password": "wrong horse"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: status %d, want 401", code)
+	}
+
+	// An expired token is refused like a used one.
+	if _, err := s.db.Exec(`INSERT INTO password_resets(token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken("expired"), userID, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/reset-password", map[string]string{"token": "expired", "newPassword": "another one"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expired token: status %d, want 400", code)
+	}
+}
+
+func TestForgotPasswordWithoutResetURLSendsNothing(t *testing.T) {
+	s, ts := newTestServer(t)
+	mail := &sentMail{}
+	s.mailer = mail
+	userID := createTestUser(t, ts, "alice")
+	if _, err := s.db.Exec(`UPDATE users SET email = 'alice@example.com', email_verified = 1 WHERE id = ?`, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doJSON(t, http.MethodPost, ts.URL+"/auth/forgot-password", map[string]string{"email": "alice@example.com"}, nil); code != http.StatusAccepted {
+		t.Fatalf("forgot-password: status %d, want 202", code)
+	}
+	if len(mail.bodies) != 0 {
+		t.Errorf("sent %q, want no email while PASSWORD_RESET_URL is unset", mail.bodies)
+	}
+}
+
+func TestUsernameCooldownReportsAvailableAt(t *testing.T) {
+	for _, envelope := range []bool{false, true} {
+		t.Run(fmt.Sprintf("envelope=%v", envelope), func(t *testing.T) {
+			s, ts := newTestServer(t)
+			userID := createTestUser(t, ts, "alice")
+			s.config.Envelope = envelope
+			url := ts.URL + "/users/" + userID
+			if code := doJSON(t, http.MethodPatch, url, map[string]string{"username": "alicia"}, nil); code != http.StatusOK {
+				t.Fatalf("first rename: status %d", code)
+			}
+			var body map[string]json.RawMessage
+			if code := doJSON(t, http.MethodPatch, url, map[string]string{"username": "ali"}, &body); code != http.StatusTooManyRequests {
+				t.Fatalf("second rename: status %d, want 429", code)
+			}
+			if envelope {
+				if err := json.Unmarshal(body["error"], &body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var code, availableAt string
+			json.Unmarshal(body["code"], &code)
+			json.Unmarshal(body["availableAt"], &availableAt)
+			if code != string(ErrCodeUsernameCooldown) {
+				t.Errorf("code = %q, want %q", code, ErrCodeUsernameCooldown)
+			}
+			if _, err := time.Parse(time.RFC3339, availableAt); err != nil {
+				t.Errorf("availableAt = %q: %v", availableAt, err)
+			}
+		})
+	}
+}
+
+func TestPatchDeckAuditsTokenUser(t *testing.T) {
+	s, ts := newTestServer(t)
+	alice := createTestUser(t, ts, "alice")
+	bob := createTestUser(t, ts, "bob")
+	var deck Deck
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", map[string]string{"name": "Spanish", "userId": alice}, &deck); code != http.StatusCreated {
+		t.Fatalf("create deck: status %d", code)
+	}
+
+	url := ts.URL + "/decks/" + deck.ID + "?userId=" + bob
+	if code := doJSON(t, http.MethodPatch, url, map[string]string{"description": "forged"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", code)
+	}
+	if code := doJSONAs(t, s, alice, http.MethodPatch, url, map[string]string{"description": "verbs"}, nil); code != http.StatusOK {
+		t.Fatalf("with a token: status %d", code)
+	}
+	if got := auditActors(t, s, deck.ID, "deck.update"); len(got) != 1 || got[0] != alice {
+		t.Errorf("audit actors = %q, want [%s]", got, alice)
+	}
+}
+
+// auditActors lists the users recorded for action on deckID, "" for none.
+func auditActors(t *testing.T, s *Server, deckID, action string) []string {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT COALESCE(user_id, '') FROM deck_audit WHERE deck_id = ? AND action = ? ORDER BY created_at`, deckID, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var actors []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			t.Fatal(err)
+		}
+		actors = append(actors, a)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return actors
+}
+
+func TestDeckTagsAuditTokenUser(t *testing.T) {
+	s, ts := newTestServer(t)
+	alice := createTestUser(t, ts, "alice")
+	var deck Deck
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", map[string]string{"name": "Spanish", "userId": alice}, &deck); code != http.StatusCreated {
+		t.Fatalf("create deck: status %d", code)
+	}
+
+	url := ts.URL + "/decks/" + deck.ID + "/tags/verbs"
+	if code := doJSON(t, http.MethodPost, url, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("tag without a token: status %d, want 401", code)
+	}
+	if code := doJSONAs(t, s, alice, http.MethodPost, url, nil, nil); code != http.StatusOK {
+		t.Fatalf("tag: status %d", code)
+	}
+	if code := doJSON(t, http.MethodDelete, url, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("untag without a token: status %d, want 401", code)
+	}
+	if code := doJSONAs(t, s, alice, http.MethodDelete, url, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("untag: status %d", code)
+	}
+	for _, action := range []string{"deck.tag", "deck.untag"} {
+		if got := auditActors(t, s, deck.ID, action); len(got) != 1 || got[0] != alice {
+			t.Errorf("%s audit actors = %q, want [%s]", action, got, alice)
+		}
+	}
+}
+
+func TestUndoReviewKeepsPinnedSchedule(t *testing.T) {
+	for _, lock := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lock=%v", lock), func(t *testing.T) {
+			s, ts := newTestServer(t)
+			userID := createTestUser(t, ts, "alice")
+			var deck Deck
+			body := map[string]interface{}{"name": "Spanish", "userId": userID, "cards": []map[string]string{{"front": "hola", "back": "hello"}}}
+			if code := doJSON(t, http.MethodPost, ts.URL+"/decks", body, &deck); code != http.StatusCreated {
+				t.Fatalf("create deck: status %d", code)
+			}
+			cardURL := ts.URL + "/cards/" + deck.Cards[0].ID
+
+			dueAt := time.Now().Add(72 * time.Hour).UTC().Format(time.RFC3339)
+			pin := map[string]interface{}{"userId": userID, "dueAt": dueAt, "lock": lock}
+			if code := doJSON(t, http.MethodPost, cardURL+"/pin-due", pin, nil); code != http.StatusOK {
+				t.Fatalf("pin-due: status %d", code)
+			}
+			review := map[string]interface{}{"userId": userID, "quality": 1}
+			if code := doJSON(t, http.MethodPost, cardURL+"/review", review, nil); code != http.StatusOK {
+				t.Fatalf("review: status %d", code)
+			}
+			var restored Schedule
+			if code := doJSON(t, http.MethodPost, cardURL+"/review/undo", map[string]string{"userId": userID}, &restored); code != http.StatusOK {
+				t.Fatalf("undo: status %d", code)
+			}
+			if restored.DueAt != dueAt || restored.Locked != lock {
+				t.Errorf("undo returned dueAt %s, locked %v; want %s, %v", restored.DueAt, restored.Locked, dueAt, lock)
+			}
+			stored, err := fetchSchedule(s.db, deck.Cards[0].ID, userID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.DueAt != dueAt || stored.Locked != lock || stored.LastReviewedAt != "" {
+				t.Errorf("stored schedule %+v; want dueAt %s, locked %v, never reviewed", stored, dueAt, lock)
+			}
+		})
+	}
+}
+
+func TestUndoFirstReviewMakesCardNew(t *testing.T) {
+	s, ts := newTestServer(t)
+	userID := createTestUser(t, ts, "alice")
+	var deck Deck
+	body := map[string]interface{}{"name": "Spanish", "userId": userID, "cards": []map[string]string{{"front": "hola", "back": "hello"}}}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", body, &deck); code != http.StatusCreated {
+		t.Fatalf("create deck: status %d", code)
+	}
+	cardURL := ts.URL + "/cards/" + deck.Cards[0].ID
+	if code := doJSON(t, http.MethodPost, cardURL+"/review", map[string]interface{}{"userId": userID, "quality": 4}, nil); code != http.StatusOK {
+		t.Fatalf("review: status %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, cardURL+"/review/undo", map[string]string{"userId": userID}, nil); code != http.StatusOK {
+		t.Fatalf("undo: status %d", code)
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM card_schedules WHERE card_id = ? AND user_id = ?`, deck.Cards[0].ID, userID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d schedules left, want none", n)
+	}
+}
+
+func TestCopyPublicDeckOwnedByTokenUser(t *testing.T) {
+	s, ts := newTestServer(t)
+	alice := createTestUser(t, ts, "alice")
+	bob := createTestUser(t, ts, "bob")
+	carol := createTestUser(t, ts, "carol")
+	var src Deck
+	if code := doJSON(t, http.MethodPost, ts.URL+"/decks", map[string]string{"name": "Spanish", "userId": alice}, &src); code != http.StatusCreated {
+		t.Fatalf("create deck: status %d", code)
+	}
+	if _, err := s.db.Exec(`UPDATE decks SET is_public = 1 WHERE id = ?`, src.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	url := ts.URL + "/public/decks/" + src.ID + "/copy"
+	if code := doJSON(t, http.MethodPost, url, map[string]string{"userId": carol}, nil); code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", code)
+	}
+	var copied Deck
+	if code := doJSONAs(t, s, bob, http.MethodPost, url, map[string]string{"userId": carol}, &copied); code != http.StatusCreated {
+		t.Fatalf("copy: status %d", code)
+	}
+	var owner string
+	if err := s.db.QueryRow(`SELECT user_id FROM decks WHERE id = ?`, copied.ID).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != bob {
+		t.Errorf("copy owned by %s, want %s", owner, bob)
+	}
+}
+
+func TestListDecksByTagMatchesGetDeck(t *testing.T) {
+	s, ts := newTestServer(t)
+	alice := createTestUser(t, ts, "alice")
+	tagged := map[string]bool{}
+	for i, name := range []string{"Spanish", "French", "German"} {
+		body := map[string]interface{}{"name": name, "userId": alice, "cards": []map[string]string{{"front": "one", "back": "1"}, {"front": "two", "back": "2"}}}
+		var d Deck
+		if code := doJSON(t, http.MethodPost, ts.URL+"/decks", body, &d); code != http.StatusCreated {
+			t.Fatalf("create %s: status %d", name, code)
+		}
+		if i < 2 {
+			if code := doJSONAs(t, s, alice, http.MethodPost, ts.URL+"/decks/"+d.ID+"/tags/languages", nil, nil); code != http.StatusOK {
+				t.Fatalf("tag %s: status %d", name, code)
+			}
+			tagged[d.ID] = true
+		}
+	}
+
+	var listed []json.RawMessage
+	if code := doJSON(t, http.MethodGet, ts.URL+"/decks?tag=languages", nil, &listed); code != http.StatusOK {
+		t.Fatalf("list: status %d", code)
+	}
+	if len(listed) != len(tagged) {
+		t.Fatalf("listed %d decks, want %d", len(listed), len(tagged))
+	}
+	for _, raw := range listed {
+		var d Deck
+		if err := json.Unmarshal(raw, &d); err != nil {
+			t.Fatal(err)
+		}
+		if !tagged[d.ID] {
+			t.Errorf("listed untagged deck %s", d.Name)
+		}
+		var single json.RawMessage
+		if code := doJSON(t, http.MethodGet, ts.URL+"/decks/"+d.ID, nil, &single); code != http.StatusOK {
+			t.Fatalf("get %s: status %d", d.Name, code)
+		}
+		if !bytes.Equal(raw, single) {
+			t.Errorf("listed %s as %s, GET /decks/{id} gives %s", d.Name, raw, single)
+		}
+	}
+}